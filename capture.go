@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/app"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// A capture file holds the raw trace events of some services. All
+// the integers are little endian.
+//
+//	file    = header block* index trailer
+//
+//	header  = magic:[8]byte("QICAPTR\x00") version:uint16 flags:uint16
+//	          reserved:uint32
+//
+//	block   = type:uint8 length:uint32 payload:[length]byte
+//
+// The readers skip the blocks of unknown type. The blocks are:
+//
+//	service (type 1) = id:uint16 name:string count:uint32
+//	                   (slot:uint32 kind:uint8 name:string){count}
+//
+// describes a service before its first event. The kind of a slot is
+// 0 for the methods, 1 for the signals and 2 for the properties.
+//
+//	event (type 2) = service:uint16 id:uint32 kind:int32 slot:uint32
+//	                 sec:int64 usec:int64 user_us:int64 system_us:int64
+//	                 caller:uint32 callee:uint32 arguments:bytes
+//
+// is a bus.EventTrace of the service. The arguments are serialized
+// with value.Bytes: the signature followed by the data.
+//
+//	string  = length:uint32 [length]byte
+//	bytes   = length:uint32 [length]byte
+//
+//	index   = count:uint32 (sec:int64 usec:int64 offset:uint64){count}
+//
+// records the time and the offset (from the beginning of the file) of
+// one event block every captureIndexInterval events. qitop reads the
+// whole capture: it only uses the index to find the end of the blocks
+// and to estimate the number of events.
+//
+//	trailer = offset:uint64 magic:[8]byte("QICAPIDX")
+//
+// gives the offset of the index. A capture interrupted before the
+// index is written is read up to its last complete block.
+const (
+	captureMagic   = "QICAPTR\x00"
+	indexMagic     = "QICAPIDX"
+	captureVersion = 1
+
+	captureService = 1
+	captureEvent   = 2
+
+	// captureIndexInterval is the number of events between two
+	// index entries.
+	captureIndexInterval = 1000
+)
+
+var byteOrder = binary.LittleEndian
+
+// captureIndex locates an event block.
+type captureIndex struct {
+	Sec    int64
+	Usec   int64
+	Offset uint64
+}
+
+// captureWriter writes a capture file. It is thread-safe.
+type captureWriter struct {
+	mutex    sync.Mutex
+	w        *bufio.Writer
+	offset   uint64
+	services uint16
+	events   int
+	index    []captureIndex
+}
+
+func newCaptureWriter(w io.Writer) (*captureWriter, error) {
+	c := &captureWriter{
+		w:     bufio.NewWriter(w),
+		index: []captureIndex{},
+	}
+	var header bytes.Buffer
+	header.WriteString(captureMagic)
+	binary.Write(&header, byteOrder, uint16(captureVersion))
+	binary.Write(&header, byteOrder, uint16(0))
+	binary.Write(&header, byteOrder, uint32(0))
+	return c, c.write(header.Bytes())
+}
+
+// write must be called with the mutex held.
+func (c *captureWriter) write(data []byte) error {
+	n, err := c.w.Write(data)
+	c.offset += uint64(n)
+	return err
+}
+
+// writeBlock must be called with the mutex held.
+func (c *captureWriter) writeBlock(kind uint8, payload []byte) error {
+	var header bytes.Buffer
+	header.WriteByte(kind)
+	binary.Write(&header, byteOrder, uint32(len(payload)))
+	if err := c.write(header.Bytes()); err != nil {
+		return err
+	}
+	return c.write(payload)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, byteOrder, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// addService writes the description of a service. It returns the ID
+// of the service to use with writeEvent.
+func (c *captureWriter) addService(name string, meta object.MetaObject) (uint16, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	id := c.services
+	c.services++
+
+	var payload bytes.Buffer
+	binary.Write(&payload, byteOrder, id)
+	writeString(&payload, name)
+	count := len(meta.Methods) + len(meta.Signals) + len(meta.Properties)
+	binary.Write(&payload, byteOrder, uint32(count))
+	slot := func(id uint32, kind memberKind, name string) {
+		binary.Write(&payload, byteOrder, id)
+		payload.WriteByte(uint8(kind))
+		writeString(&payload, name)
+	}
+	for id, m := range meta.Methods {
+		slot(id, memberMethod, m.Name)
+	}
+	for id, s := range meta.Signals {
+		slot(id, memberSignal, s.Name)
+	}
+	for id, p := range meta.Properties {
+		slot(id, memberProperty, p.Name)
+	}
+	return id, c.writeBlock(captureService, payload.Bytes())
+}
+
+// writeEvent writes a trace event of a service.
+func (c *captureWriter) writeEvent(service uint16, e bus.EventTrace) error {
+	var payload bytes.Buffer
+	binary.Write(&payload, byteOrder, service)
+	binary.Write(&payload, byteOrder, e.Id)
+	binary.Write(&payload, byteOrder, e.Kind)
+	binary.Write(&payload, byteOrder, e.SlotId)
+	binary.Write(&payload, byteOrder, e.Timestamp.Tv_sec)
+	binary.Write(&payload, byteOrder, e.Timestamp.Tv_usec)
+	binary.Write(&payload, byteOrder, e.UserUsTime)
+	binary.Write(&payload, byteOrder, e.SystemUsTime)
+	binary.Write(&payload, byteOrder, e.CallerContext)
+	binary.Write(&payload, byteOrder, e.CalleeContext)
+	args := value.Bytes(e.Arguments)
+	binary.Write(&payload, byteOrder, uint32(len(args)))
+	payload.Write(args)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.events%captureIndexInterval == 0 {
+		c.index = append(c.index, captureIndex{
+			Sec:    e.Timestamp.Tv_sec,
+			Usec:   e.Timestamp.Tv_usec,
+			Offset: c.offset,
+		})
+	}
+	c.events++
+	return c.writeBlock(captureEvent, payload.Bytes())
+}
+
+// close writes the index and the trailer.
+func (c *captureWriter) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	offset := c.offset
+	var index bytes.Buffer
+	binary.Write(&index, byteOrder, uint32(len(c.index)))
+	binary.Write(&index, byteOrder, c.index)
+	binary.Write(&index, byteOrder, offset)
+	index.WriteString(indexMagic)
+	if err := c.write(index.Bytes()); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// captureReader reads a capture file.
+type captureReader struct {
+	r      *bufio.Reader
+	offset uint64
+	// size is the number of bytes of the blocks: the lengths read
+	// are checked against it before the allocation.
+	size uint64
+	// end is the offset of the index, 0 if the file has no index.
+	end uint64
+	// events estimates the number of events from the index.
+	events   int
+	services map[uint16]captureServiceInfo
+}
+
+// captureSlot identifies a member: the methods, the signals and the
+// properties share the slot IDs.
+type captureSlot struct {
+	kind memberKind
+	id   uint32
+}
+
+// captureServiceInfo describes a service of a capture file.
+type captureServiceInfo struct {
+	name  string
+	slots map[captureSlot]string
+}
+
+// member returns the name and the kind of the member of an event. The
+// signal events are emitted by the signals and the properties.
+func (s captureServiceInfo) member(kind int32, id uint32) (string, memberKind) {
+	kinds := []memberKind{memberMethod}
+	if kind == traceSignal {
+		kinds = []memberKind{memberSignal, memberProperty}
+	}
+	for _, k := range kinds {
+		if name, ok := s.slots[captureSlot{k, id}]; ok {
+			return name, k
+		}
+	}
+	return "", kinds[0]
+}
+
+// readCaptureIndex returns the offset of the index and the index from
+// the trailer of the file. The offset is 0 when the file has no
+// index.
+func readCaptureIndex(file *os.File) (uint64, []captureIndex, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if info.Size() < 32 {
+		return 0, nil, nil
+	}
+	trailer := make([]byte, 16)
+	if _, err := file.ReadAt(trailer, info.Size()-16); err != nil {
+		return 0, nil, err
+	}
+	if string(trailer[8:]) != indexMagic {
+		return 0, nil, nil
+	}
+	offset := byteOrder.Uint64(trailer[:8])
+	section := io.NewSectionReader(file, int64(offset), info.Size()-16-int64(offset))
+	var count uint32
+	if err := binary.Read(section, byteOrder, &count); err != nil {
+		return 0, nil, err
+	}
+	entry := int64(binary.Size(captureIndex{}))
+	if int64(count) > (section.Size()-4)/entry {
+		return 0, nil, fmt.Errorf("invalid index: %d entries in %d bytes",
+			count, section.Size()-4)
+	}
+	index := make([]captureIndex, count)
+	if err := binary.Read(section, byteOrder, index); err != nil {
+		return 0, nil, err
+	}
+	return offset, index, nil
+}
+
+func (c *captureReader) read(data interface{}) error {
+	err := binary.Read(c.r, byteOrder, data)
+	c.offset += uint64(binary.Size(data))
+	return err
+}
+
+func (c *captureReader) readBytes() ([]byte, error) {
+	var size uint32
+	if err := c.read(&size); err != nil {
+		return nil, err
+	}
+	if c.offset > c.size || uint64(size) > c.size-c.offset {
+		// the block ends after the input: corrupted or truncated.
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	n, err := io.ReadFull(c.r, data)
+	c.offset += uint64(n)
+	return data, err
+}
+
+func (c *captureReader) readHeader() error {
+	header := make([]byte, 16)
+	n, err := io.ReadFull(c.r, header)
+	c.offset += uint64(n)
+	if err != nil {
+		return err
+	}
+	if string(header[:8]) != captureMagic {
+		return errors.New("not a capture file")
+	}
+	if version := byteOrder.Uint16(header[8:10]); version != captureVersion {
+		return fmt.Errorf("unsupported capture version: %d", version)
+	}
+	return nil
+}
+
+func (c *captureReader) readService(payload []byte) error {
+	r := &captureReader{
+		r:    bufio.NewReader(bytes.NewReader(payload)),
+		size: uint64(len(payload)),
+	}
+	var id uint16
+	var count uint32
+	if err := r.read(&id); err != nil {
+		return err
+	}
+	name, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	if err := r.read(&count); err != nil {
+		return err
+	}
+	service := captureServiceInfo{
+		name:  string(name),
+		slots: map[captureSlot]string{},
+	}
+	for i := uint32(0); i < count; i++ {
+		var slot uint32
+		var kind uint8
+		if err := r.read(&slot); err != nil {
+			return err
+		}
+		if err := r.read(&kind); err != nil {
+			return err
+		}
+		name, err := r.readBytes()
+		if err != nil {
+			return err
+		}
+		service.slots[captureSlot{memberKind(kind), slot}] = string(name)
+	}
+	c.services[id] = service
+	return nil
+}
+
+func (c *captureReader) readEvent(payload []byte) (record, error) {
+	r := &captureReader{
+		r:    bufio.NewReader(bytes.NewReader(payload)),
+		size: uint64(len(payload)),
+	}
+	var service uint16
+	var fields struct {
+		ID            uint32
+		Kind          int32
+		SlotID        uint32
+		Sec           int64
+		Usec          int64
+		UserUsTime    int64
+		SystemUsTime  int64
+		CallerContext uint32
+		CalleeContext uint32
+	}
+	if err := r.read(&service); err != nil {
+		return record{}, err
+	}
+	if err := r.read(&fields); err != nil {
+		return record{}, err
+	}
+	args, err := r.readBytes()
+	if err != nil {
+		return record{}, err
+	}
+	info, ok := c.services[service]
+	if !ok {
+		return record{}, fmt.Errorf("unknown service: %d", service)
+	}
+	name, kind := info.member(fields.Kind, fields.SlotID)
+	member := ""
+	if kind != memberMethod {
+		member = kind.String()
+	}
+	return record{
+		Kind:    recordTrace,
+		Time:    time.Unix(fields.Sec, fields.Usec*1000),
+		Service: info.name,
+		Method:  name,
+		Member:  member,
+		Trace: &traceRecord{
+			ID:            fields.ID,
+			Kind:          fields.Kind,
+			SlotID:        fields.SlotID,
+			Arguments:     args,
+			Sec:           fields.Sec,
+			Usec:          fields.Usec,
+			UserUsTime:    fields.UserUsTime,
+			SystemUsTime:  fields.SystemUsTime,
+			CallerContext: fields.CallerContext,
+			CalleeContext: fields.CalleeContext,
+		},
+	}, nil
+}
+
+// readRecords returns the events of the file as trace records. Without
+// index, the reading stops at the last complete block.
+func (c *captureReader) readRecords() ([]record, error) {
+	if err := c.readHeader(); err != nil {
+		return nil, err
+	}
+	records := make([]record, 0, c.events)
+	for c.end == 0 || c.offset < c.end {
+		var kind uint8
+		if err := c.read(&kind); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		payload, err := c.readBytes()
+		if c.end == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// interrupted capture: the last block is incomplete.
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case captureService:
+			err = c.readService(payload)
+		case captureEvent:
+			var r record
+			r, err = c.readEvent(payload)
+			records = append(records, r)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// callStatistics computes the method statistics of the trace records
+// every second: it lets the top list display a capture. The count of
+// the signals and the properties is their number of emissions.
+func callStatistics(traces []record) []record {
+	stats := map[action]*record{}
+	get := func(r record) *record {
+		a := action{r.Service, r.Method, parseMemberKind(r.Member)}
+		s, ok := stats[a]
+		if !ok {
+			s = &record{
+				Service: r.Service,
+				Method:  r.Method,
+				Member:  r.Member,
+			}
+			if a.kind == memberMethod {
+				s.WallMin = math.MaxFloat64
+			}
+			stats[a] = s
+		}
+		return s
+	}
+	pending := map[string]map[uint32]bus.EventTrace{}
+	records := make([]record, 0, len(traces))
+	var next time.Time
+	for _, r := range traces {
+		if r.Time.After(next) && len(stats) != 0 {
+			for _, s := range stats {
+				s.Time = next
+				records = append(records, *s)
+			}
+		}
+		if r.Time.After(next) {
+			next = r.Time.Truncate(time.Second).Add(time.Second)
+		}
+		records = append(records, r)
+
+		e, err := r.Trace.event()
+		if err != nil {
+			continue
+		}
+		if e.Kind == traceSignal {
+			s := get(r)
+			size := float64(len(r.Trace.Arguments))
+			s.SizeAvg = (s.SizeAvg*float64(s.Count) + size) / float64(s.Count+1)
+			s.Count++
+			continue
+		}
+		if pending[r.Service] == nil {
+			pending[r.Service] = map[uint32]bus.EventTrace{}
+		}
+		call, response, ok := matchEvent(pending[r.Service], e)
+		// the failed calls are counted like in the live statistics.
+		if !ok {
+			continue
+		}
+		evt := newCallEvent(call, response)
+		latency := float64(evt.duration.Microseconds())
+		s := get(r)
+		total := s.WallAvg * float64(s.Count)
+		s.Count++
+		s.WallAvg = (total + latency) / float64(s.Count)
+		s.WallMin = math.Min(s.WallMin, latency)
+		s.WallMax = math.Max(s.WallMax, latency)
+		user := s.UserAvg*float64(s.Count-1) + float64(evt.userUsTime)
+		s.UserAvg = user / float64(s.Count)
+		system := s.SysAvg*float64(s.Count-1) + float64(evt.systemUsTime)
+		s.SysAvg = system / float64(s.Count)
+	}
+	for _, s := range stats {
+		s.Time = next
+		records = append(records, *s)
+	}
+	return records
+}
+
+// loadCapture opens a capture file for the replay.
+func loadCapture(filename string) (*player, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	end, index, err := readCaptureIndex(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(info.Size())
+	if end != 0 {
+		size = end
+	}
+	reader := &captureReader{
+		r:        bufio.NewReader(file),
+		size:     size,
+		end:      end,
+		events:   len(index) * captureIndexInterval,
+		services: map[uint16]captureServiceInfo{},
+	}
+	traces, err := reader.readRecords()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if len(traces) == 0 {
+		return nil, fmt.Errorf("%s: empty capture", filename)
+	}
+	sort.SliceStable(traces, func(i, j int) bool {
+		return traces[i].Time.Before(traces[j].Time)
+	})
+	return newPlayer(callStatistics(traces)), nil
+}
+
+// runCapture implements the capture command: it writes the trace
+// events of some services into a capture file.
+func runCapture(args []string) (err error) {
+
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	output := flags.String("o", "", "output file")
+	duration := flags.Duration("duration", 0,
+		"capture duration (0 captures until interrupted)")
+	traced := flags.String("trace", "",
+		"comma separated list of services whose trace events are captured")
+	flags.Parse(args)
+
+	if *output == "" || *traced == "" {
+		return fmt.Errorf("capture: missing -o or -trace")
+	}
+
+	sess, err = app.SessionFromFlag()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := newCaptureWriter(file)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(*duration)
+	defer cancel()
+
+	// the events already captured are written on every exit path.
+	var wait sync.WaitGroup
+	defer func() {
+		cancel()
+		wait.Wait()
+		if closeErr := writer.close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	src := liveSource{sess}
+	for _, service := range strings.Split(*traced, ",") {
+		meta, cancelTrace, events, err := src.trace(service)
+		if err != nil {
+			return err
+		}
+		id, err := writer.addService(service, meta)
+		if err != nil {
+			cancelTrace()
+			return err
+		}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for {
+				select {
+				case e, ok := <-events:
+					if !ok {
+						return
+					}
+					if err := writer.writeEvent(id, e); err != nil {
+						log.Print(err)
+					}
+				case <-ctx.Done():
+					cancelTrace()
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	return nil
+}
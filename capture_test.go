@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// captureEvents are the events of the test captures. The method and
+// the signal share slot 1.
+var captureEvents = []bus.EventTrace{
+	{Id: 7, Kind: int32(net.Call), SlotId: 1, Arguments: value.Int(1),
+		Timestamp: bus.Timeval{Tv_sec: 1, Tv_usec: 0}},
+	{Id: 7, Kind: int32(net.Reply), SlotId: 1, Arguments: value.Int(2),
+		Timestamp: bus.Timeval{Tv_sec: 1, Tv_usec: 2000}, UserUsTime: 10},
+	{Id: 8, Kind: int32(net.Call), SlotId: 1, Arguments: value.Int(3),
+		Timestamp: bus.Timeval{Tv_sec: 1, Tv_usec: 500000}},
+	{Id: 8, Kind: int32(net.Error), SlotId: 1, Arguments: value.String("failed"),
+		Timestamp: bus.Timeval{Tv_sec: 1, Tv_usec: 600000}},
+	{Id: 0, Kind: traceSignal, SlotId: 1, Arguments: value.String("hello"),
+		Timestamp: bus.Timeval{Tv_sec: 1, Tv_usec: 700000}},
+}
+
+// writeTestCapture writes captureEvents. The index and the trailer are
+// not written unless closed is set.
+func writeTestCapture(t *testing.T, closed bool) string {
+	filename := filepath.Join(t.TempDir(), "test.qicap")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := newCaptureWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := object.MetaObject{
+		Methods: map[uint32]object.MetaMethod{1: {Uid: 1, Name: "call"}},
+		Signals: map[uint32]object.MetaSignal{1: {Uid: 1, Name: "changed"}},
+	}
+	id, err := w.addService("A", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range captureEvents {
+		if err := w.writeEvent(id, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closed {
+		err = w.close()
+	} else {
+		err = w.w.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// traces returns the trace records of a player.
+func traces(p *player) []record {
+	list := []record{}
+	for _, r := range p.records {
+		if r.Kind == recordTrace {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	p, err := loadCapture(writeTestCapture(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := traces(p)
+	if len(list) != len(captureEvents) {
+		t.Fatalf("got %d events, want %d", len(list), len(captureEvents))
+	}
+	for i, r := range list {
+		e, err := r.Trace.event()
+		if err != nil {
+			t.Fatalf("event %d: %s", i, err)
+		}
+		want := captureEvents[i]
+		if e.Id != want.Id || e.Kind != want.Kind || e.SlotId != want.SlotId ||
+			e.Timestamp != want.Timestamp || e.UserUsTime != want.UserUsTime {
+			t.Errorf("event %d: got %+v, want %+v", i, e, want)
+		}
+		if !bytes.Equal(value.Bytes(e.Arguments), value.Bytes(want.Arguments)) {
+			t.Errorf("event %d: arguments differ", i)
+		}
+		method, member := "call", ""
+		if want.Kind == traceSignal {
+			method, member = "changed", "signal"
+		}
+		if r.Service != "A" || r.Method != method || r.Member != member {
+			t.Errorf("event %d: got %s.%s (%s), want A.%s (%s)", i,
+				r.Service, r.Method, r.Member, method, member)
+		}
+	}
+	if name := p.metas["A"].Signals[1].Name; name != "changed" {
+		t.Errorf("signal: got %q, want changed", name)
+	}
+	if name := p.metas["A"].Methods[1].Name; name != "call" {
+		t.Errorf("method: got %q, want call", name)
+	}
+}
+
+func TestCallStatistics(t *testing.T) {
+	p, err := loadCapture(writeTestCapture(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := map[action]record{}
+	for _, r := range p.records {
+		if r.Kind == recordStats {
+			last[action{r.Service, r.Method, parseMemberKind(r.Member)}] = r
+		}
+	}
+	call := last[action{"A", "call", memberMethod}]
+	// the failed call is counted.
+	if call.Count != 2 {
+		t.Errorf("calls: got %d, want 2", call.Count)
+	}
+	if call.WallMin != 2000 || call.WallMax != 100000 {
+		t.Errorf("latency: got min %.0f max %.0f, want 2000 100000",
+			call.WallMin, call.WallMax)
+	}
+	signal := last[action{"A", "changed", memberSignal}]
+	if signal.Count != 1 || signal.SizeAvg == 0 {
+		t.Errorf("emissions: got %d (%.0f bytes), want 1", signal.Count,
+			signal.SizeAvg)
+	}
+}
+
+func TestCaptureInterrupted(t *testing.T) {
+	filename := writeTestCapture(t, false)
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut the last event in the middle.
+	if err := os.Truncate(filename, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(traces(p)), len(captureEvents)-1; got != want {
+		t.Errorf("got %d events, want %d", got, want)
+	}
+}
+
+func TestCaptureNotACapture(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "record.json")
+	err := os.WriteFile(filename, []byte(`{"kind":"trace"}`+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCapture(filename); err == nil {
+		t.Error("expecting an error")
+	}
+}
+
+func TestCaptureCorrupted(t *testing.T) {
+	tests := []struct {
+		name   string
+		closed bool
+		// offset returns the offset of the uint32 overwritten.
+		offset func(data []byte) int
+		err    string
+	}{
+		{"index count", true, func(data []byte) int {
+			return int(byteOrder.Uint64(data[len(data)-16:]))
+		}, "invalid index"},
+		{"block size", true, func(data []byte) int {
+			// after the header and the kind of the first block.
+			return 17
+		}, "unexpected EOF"},
+		{"block size without index", false, func(data []byte) int {
+			return 17
+		}, "empty capture"},
+	}
+	for _, test := range tests {
+		filename := writeTestCapture(t, test.closed)
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byteOrder.PutUint32(data[test.offset(data):], math.MaxUint32)
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadCapture(filename)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
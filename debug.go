@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/value"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+const (
+	// debugWindow is how long the debug lines are held to reorder
+	// them by timestamp.
+	debugWindow = 500 * time.Millisecond
+
+	// maxDebugLines is the number of lines kept by the debug view.
+	maxDebugLines = 2000
+
+	// debugTail is the number of lines displayed when following.
+	debugTail = 200
+)
+
+// debugLine is a trace event or a log message of the debug view.
+type debugLine struct {
+	timestamp time.Time
+	arrival   time.Time
+	text      string
+	color     cell.Color
+	// start and duration are set for the replies.
+	start    time.Time
+	duration time.Duration
+}
+
+// debugView merges the trace events and the log messages of the
+// traced method in timestamp order.
+type debugView struct {
+	// display rolls to show the last lines. detail does not roll: it
+	// shows an inspected slow call from its start.
+	display *text.Text
+	detail  *text.Text
+
+	mutex   sync.Mutex
+	pending []debugLine
+	lines   []debugLine
+	// inspected is the index in lines of the reply of the
+	// inspected slow call. -1 when following the last lines.
+	inspected int
+}
+
+func newDebugView(ctx context.Context, display, detail *text.Text) *debugView {
+	d := &debugView{
+		display:   display,
+		detail:    detail,
+		pending:   []debugLine{},
+		lines:     []debugLine{},
+		inspected: -1,
+	}
+	go func() {
+		ticker := time.NewTicker(debugWindow / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				d.flush(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *debugView) reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending = d.pending[:0]
+	d.lines = d.lines[:0]
+	d.inspected = -1
+	d.updateUI()
+}
+
+func (d *debugView) add(l debugLine) {
+	l.arrival = time.Now()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending = append(d.pending, l)
+}
+
+// addTrace adds a trace event of the traced method. The duration is
+// set for the replies.
+func (d *debugView) addTrace(method string, e bus.EventTrace, start time.Time, duration time.Duration) {
+	timestamp := time.Unix(e.Timestamp.Tv_sec, e.Timestamp.Tv_usec*1000)
+	l := debugLine{
+		timestamp: timestamp,
+		color:     cell.ColorCyan,
+	}
+	switch uint8(e.Kind) {
+	case net.Call:
+		l.text = fmt.Sprintf("[TRACE] call %s (id: %d)", method, e.Id)
+	case net.Reply:
+		l.text = fmt.Sprintf("[TRACE] reply %s (id: %d) %s",
+			method, e.Id, duration)
+		l.start, l.duration = start, duration
+	case net.Error:
+		l.text = fmt.Sprintf("[TRACE] error %s (id: %d) %s",
+			method, e.Id, duration)
+		l.color = cell.ColorRed
+		l.start, l.duration = start, duration
+	case traceSignal:
+		l.text = fmt.Sprintf("[TRACE] emit %s (%d bytes)",
+			method, len(value.Bytes(e.Arguments)))
+		l.color = cell.ColorMagenta
+	default:
+		l.text = fmt.Sprintf("[TRACE] %d %s (id: %d)", e.Kind, method, e.Id)
+	}
+	d.add(l)
+}
+
+// flush moves the lines received before the reorder window into the
+// view.
+func (d *debugView) flush(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.pending) == 0 {
+		return
+	}
+	kept := d.pending[:0]
+	flushed := 0
+	for _, l := range d.pending {
+		if now.Sub(l.arrival) < debugWindow {
+			kept = append(kept, l)
+			continue
+		}
+		i := sort.Search(len(d.lines), func(i int) bool {
+			return d.lines[i].timestamp.After(l.timestamp)
+		})
+		d.lines = append(d.lines, debugLine{})
+		copy(d.lines[i+1:], d.lines[i:])
+		d.lines[i] = l
+		if d.inspected >= i {
+			d.inspected++
+		}
+		flushed++
+	}
+	d.pending = kept
+	if len(d.lines) > 2*maxDebugLines {
+		drop := len(d.lines) - maxDebugLines
+		d.lines = d.lines[drop:]
+		if d.inspected != -1 {
+			// an inspected call which is dropped stays displayed:
+			// n and N continue from the oldest line.
+			d.inspected -= drop
+			if d.inspected < 0 {
+				d.inspected = 0
+			}
+		}
+	}
+	if flushed != 0 && d.inspected == -1 {
+		d.updateUI()
+	}
+}
+
+// inspect moves to the next slow call in the direction of step (-1:
+// older, 1: newer). A call is slow when its latency exceeds the
+// APDEX target.
+func (d *debugView) inspect(step int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	i := d.inspected
+	if i == -1 {
+		i = len(d.lines)
+	}
+	for i += step; i >= 0 && i < len(d.lines); i += step {
+		if d.lines[i].duration > *apdexT {
+			d.inspected = i
+			d.updateUI()
+			return
+		}
+	}
+}
+
+// follow displays the last lines.
+func (d *debugView) follow() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.inspected = -1
+	d.updateUI()
+}
+
+// inspecting returns true when a slow call is displayed.
+func (d *debugView) inspecting() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.inspected != -1
+}
+
+// widget returns the text widget to display: detail when a slow call is
+// inspected.
+func (d *debugView) widget() *text.Text {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.inspected != -1 {
+		return d.detail
+	}
+	return d.display
+}
+
+// updateUI must be called with the mutex held.
+func (d *debugView) updateUI() {
+	if d.inspected == -1 {
+		d.display.Reset()
+		start := 0
+		if len(d.lines) > debugTail {
+			start = len(d.lines) - debugTail
+		}
+		for _, l := range d.lines[start:] {
+			d.write(d.display, l)
+		}
+		return
+	}
+	d.detail.Reset()
+	reply := d.lines[d.inspected]
+	d.detail.Write(fmt.Sprintf("Slow call of %s at %s (n: older, N: newer, esc: follow)\n",
+		reply.duration, reply.start.Format("15:04:05.000")),
+		text.WriteCellOpts(cell.FgColor(cell.ColorYellow)))
+	for _, l := range d.lines {
+		if l.timestamp.Before(reply.start) {
+			continue
+		}
+		if l.timestamp.After(reply.timestamp) {
+			break
+		}
+		d.write(d.detail, l)
+	}
+}
+
+func (d *debugView) write(t *text.Text, l debugLine) {
+	t.Write(fmt.Sprintf("%s %s\n",
+		l.timestamp.Format("15:04:05.000"), l.text),
+		text.WriteCellOpts(cell.FgColor(l.color)))
+}
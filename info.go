@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/lugu/qiloop/bus"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
 )
 
 type info struct {
@@ -12,11 +14,27 @@ type info struct {
 }
 
 func newInfo(sess bus.Session, w *widgets, service, method string) (*info, error) {
-	w.serviceInfo.Reset()
-	w.serviceInfo.Write(fmt.Sprintf("Service: %s\n", service))
-	w.serviceInfo.Write(fmt.Sprintf("Method: %s", method))
+	showInfo(w, service, method)
 	return &info{
 		service: service,
 		method:  method,
 	}, nil
 }
+
+// detail is a line of the info panel.
+type detail struct {
+	text  string
+	color cell.Color
+}
+
+// showInfo displays the traced method followed by some details, one
+// per line.
+func showInfo(w *widgets, service, method string, details ...detail) {
+	w.serviceInfo.Reset()
+	w.serviceInfo.Write(fmt.Sprintf("Service: %s\n", service))
+	w.serviceInfo.Write(fmt.Sprintf("Method: %s", method))
+	for _, d := range details {
+		w.serviceInfo.Write("\n"+d.text,
+			text.WriteCellOpts(cell.FgColor(d.color)))
+	}
+}
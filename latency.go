@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mum4k/termdash/cell"
+)
+
+// maxDurations is the number of latencies kept to compute the
+// distribution.
+const maxDurations = 10000
+
+// latencyBuckets are the upper bounds of the histogram buckets. The
+// last bucket counts the latencies above the last bound.
+var latencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	20 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// latencyLabels returns the labels of the histogram buckets.
+func latencyLabels() []string {
+	labels := make([]string, len(latencyBuckets)+1)
+	for i, bound := range latencyBuckets {
+		labels[i] = shortDuration(bound)
+	}
+	labels[len(latencyBuckets)] = ">" + labels[len(latencyBuckets)-1]
+	return labels
+}
+
+// shortDuration formats a duration of the histogram scale.
+func shortDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%ds", d/time.Second)
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%dm", d/time.Millisecond)
+	default:
+		return fmt.Sprintf("%dµ", d/time.Microsecond)
+	}
+}
+
+// histogram counts the latencies of each bucket.
+func histogram(durations []time.Duration) []int {
+	counts := make([]int, len(latencyBuckets)+1)
+	for _, d := range durations {
+		i := sort.Search(len(latencyBuckets), func(i int) bool {
+			return d <= latencyBuckets[i]
+		})
+		counts[i]++
+	}
+	return counts
+}
+
+// percentile returns the p-th percentile (0 < p <= 100) of sorted
+// latencies using the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100.0*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// percentiles describes the latency distribution.
+func percentiles(durations []time.Duration) detail {
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return detail{
+		text: fmt.Sprintf("Latency p50: %s p90: %s p99: %s p999: %s",
+			percentile(sorted, 50).Round(time.Microsecond),
+			percentile(sorted, 90).Round(time.Microsecond),
+			percentile(sorted, 99).Round(time.Microsecond),
+			percentile(sorted, 99.9).Round(time.Microsecond)),
+		color: cell.ColorDefault,
+	}
+}
+
+// apdex scores the latencies against a target T: calls faster than
+// T satisfy the users, calls faster than 4T are tolerated. Errors
+// are frustrating.
+type apdex struct {
+	target     time.Duration
+	satisfied  int
+	tolerating int
+	total      int
+}
+
+func (a *apdex) add(d time.Duration, failed bool) {
+	a.total++
+	if failed {
+		return
+	}
+	if d <= a.target {
+		a.satisfied++
+	} else if d <= 4*a.target {
+		a.tolerating++
+	}
+}
+
+// score returns the APDEX score between 0 and 1.
+func (a *apdex) score() float64 {
+	if a.total == 0 {
+		return 1
+	}
+	return (float64(a.satisfied) + float64(a.tolerating)/2) /
+		float64(a.total)
+}
+
+func (a *apdex) detail() detail {
+	score := a.score()
+	rating, color := "unacceptable", cell.ColorRed
+	switch {
+	case score >= 0.94:
+		rating, color = "excellent", cell.ColorGreen
+	case score >= 0.85:
+		rating, color = "good", cell.ColorGreen
+	case score >= 0.70:
+		rating, color = "fair", cell.ColorYellow
+	case score >= 0.50:
+		rating, color = "poor", cell.ColorRed
+	}
+	return detail{
+		text: fmt.Sprintf("APDEX (T=%s): %.2f %s (%d calls)",
+			a.target, score, rating, a.total),
+		color: color,
+	}
+}
+
+// slo tracks the objective of a percentage of calls faster than a
+// latency. Errors count as slow calls.
+type slo struct {
+	latency time.Duration
+	// objective is the expected ratio of good calls.
+	objective float64
+	good      int
+	total     int
+}
+
+func (s *slo) add(d time.Duration, failed bool) {
+	s.total++
+	if !failed && d <= s.latency {
+		s.good++
+	}
+}
+
+// burnRate returns how fast the error budget is consumed: above 1
+// the objective is missed.
+func (s *slo) burnRate() float64 {
+	if s.total == 0 {
+		return 0
+	}
+	bad := float64(s.total-s.good) / float64(s.total)
+	return bad / (1 - s.objective)
+}
+
+func (s *slo) detail() detail {
+	ratio := 100.0
+	if s.total != 0 {
+		ratio = float64(s.good) * 100.0 / float64(s.total)
+	}
+	burnRate := s.burnRate()
+	color := cell.ColorGreen
+	if burnRate > 1 {
+		color = cell.ColorRed
+	} else if burnRate > 0.5 {
+		color = cell.ColorYellow
+	}
+	return detail{
+		text: fmt.Sprintf("SLO %g%% < %s: %.2f%% burn rate: %.2f",
+			s.objective*100, s.latency, ratio, burnRate),
+		color: color,
+	}
+}
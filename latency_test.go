@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	us := time.Microsecond
+	counts := histogram([]time.Duration{
+		5 * us, 10 * us, // first bucket: the bounds are inclusive
+		11 * us,
+		time.Hour, // above the last bound
+	})
+	if len(counts) != len(latencyBuckets)+1 {
+		t.Fatalf("got %d buckets, want %d", len(counts), len(latencyBuckets)+1)
+	}
+	want := map[int]int{0: 2, 1: 1, len(latencyBuckets): 1}
+	for i, count := range counts {
+		if count != want[i] {
+			t.Errorf("bucket %d: got %d, want %d", i, count, want[i])
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 50, 0},
+		{"single", []time.Duration{time.Second}, 99, time.Second},
+		{"p50", sorted, 50, 50 * time.Millisecond},
+		{"p90", sorted, 90, 90 * time.Millisecond},
+		{"p99.9", sorted, 99.9, 100 * time.Millisecond},
+		{"p100", sorted, 100, 100 * time.Millisecond},
+		{"tiny p", sorted, 0.1, time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := percentile(test.sorted, test.p); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApdex(t *testing.T) {
+	ms := time.Millisecond
+	type call struct {
+		d      time.Duration
+		failed bool
+	}
+	tests := []struct {
+		name  string
+		calls []call
+		want  float64
+	}{
+		{"no call", nil, 1},
+		{"satisfied", []call{{5 * ms, false}, {1 * ms, false}}, 1},
+		{"tolerating", []call{{6 * ms, false}, {20 * ms, false}}, 0.5},
+		{"frustrated", []call{{21 * ms, false}}, 0},
+		{"error", []call{{1 * ms, true}, {1 * ms, false}}, 0.5},
+	}
+	for _, test := range tests {
+		a := apdex{target: 5 * ms}
+		for _, c := range test.calls {
+			a.add(c.d, c.failed)
+		}
+		if got := a.score(); got != test.want {
+			t.Errorf("%s: got %.2f, want %.2f", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBurnRate(t *testing.T) {
+	s := slo{latency: 20 * time.Millisecond, objective: 0.99}
+	if got := s.burnRate(); got != 0 {
+		t.Errorf("no call: got %.2f, want 0", got)
+	}
+	for i := 0; i < 98; i++ {
+		s.add(time.Millisecond, false)
+	}
+	s.add(time.Second, false)
+	s.add(time.Millisecond, true)
+	// 2% of bad calls for a budget of 1%
+	if got := s.burnRate(); got < 1.99 || got > 2.01 {
+		t.Errorf("got %.2f, want 2", got)
+	}
+}
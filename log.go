@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/lugu/qiloop/bus"
 	qilog "github.com/lugu/qiloop/bus/logger"
-	"github.com/lugu/qiloop/bus/services"
 	"github.com/mum4k/termdash/cell"
 	"github.com/mum4k/termdash/widgets/text"
 )
@@ -33,61 +32,30 @@ type logger struct {
 	cancel func()
 }
 
-func newLogger(sess bus.Session, w *widgets, service, method string) (*logger, error) {
+func newLogger(w *widgets, service, method string) (*logger, error) {
 	w.logScroll.Reset()
 
-	directory, err := services.ServiceDirectory(sess)
+	cancel, logs, err := input.logs(service)
 	if err != nil {
 		return nil, err
 	}
-	info, err := directory.Service(service)
-	if err != nil {
-		return nil, fmt.Errorf("service not found (%s): %s", service, err)
-	}
-	location := fmt.Sprintf("%s:%d", info.MachineId, info.ProcessId)
-
-	logManager, err := qilog.LogManager(sess)
-	if err != nil {
-		return nil, fmt.Errorf("access LogManager service: %s", err)
-	}
-	logListener, err := logManager.CreateListener()
-	if err != nil {
-		return nil, fmt.Errorf("create listener: %s", err)
-	}
-
-	err = logListener.ClearFilters()
-	if err != nil {
-		return nil, fmt.Errorf("clear filters: %s", err)
-	}
-	cancel, logs, err := logListener.SubscribeOnLogMessages()
-	if err != nil {
-		return nil, fmt.Errorf("subscribe logs: %s", err)
-	}
-
-	err = logListener.SetLevel(logLevel)
-	if err != nil {
-		return nil, fmt.Errorf("set verbosity: %s", err)
-	}
 
 	go func() {
-		defer logListener.Terminate(logListener.Proxy().ObjectID())
 		for {
 			msgs, ok := <-logs
 			if !ok {
-				w.logScroll.Reset()
 				return
 			}
 			for _, m := range msgs {
-				if m.Level == qilog.LogLevelNone {
-					continue
-				}
-				if m.Location != location {
-					continue
-				}
 				color, info := label(m.Level)
 				message := fmt.Sprintf("%s %s\n", info, m.Message)
 				opt := text.WriteCellOpts(cell.FgColor(color))
 				w.logScroll.Write(message, opt)
+				w.debug.add(debugLine{
+					timestamp: time.Unix(0, int64(m.SystemDate.Ns)),
+					text:      fmt.Sprintf("[LOG %s %s", info[1:], m.Message),
+					color:     color,
+				})
 			}
 		}
 	}()
@@ -23,6 +23,7 @@ import (
 	"github.com/mum4k/termdash/terminal/termbox"
 	"github.com/mum4k/termdash/terminal/terminalapi"
 
+	"github.com/mum4k/termdash/widgets/barchart"
 	"github.com/mum4k/termdash/widgets/linechart"
 	"github.com/mum4k/termdash/widgets/text"
 )
@@ -45,23 +46,75 @@ const (
 	layoutTopTraceLogs
 )
 
+// bottomView represents the possible contents of the panel below the
+// top list in the trace layout.
+type bottomView int
+
+const (
+	// bottomLogs: the logs of the process
+	bottomLogs bottomView = iota
+	// bottomDebug: the traces and the logs merged by timestamp
+	bottomDebug
+	// bottomPayloads: the arguments and the responses of the calls
+	bottomPayloads
+	// bottomPending: the calls waiting for a response
+	bottomPending
+)
+
 var (
 	sess bus.Session
 
+	// source of the traces and logs: the session or a recording
+	input source
+
 	// log level displayed
 	logLevel qilog.LogLevel
 
+	// objects tracked in addition to the main object of the
+	// services, by service name
+	secondaryObjects map[string][]uint32
+
+	// latency thresholds of the top list, by service name
+	thresholds map[string]threshold
+
 	// application error status
 	mainErr error = nil
 )
 
 var (
 	service = flag.String("service", "", "service name")
-	method  = flag.String("method", "", "method name")
+	method  = flag.String("method", "", "method name (optional: all the methods of the service are traced)")
 	logFile = flag.String("log-file", "", "file where to write qitop logs")
 	level   = flag.Int("log-level", 4,
 		"log level, 1:fatal, 2:error, 3:warning, 4:info, 5:verbose, 6:debug")
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	replayFile = flag.String("replay", "", "replay a file produced by the record command")
+	window     = flag.Duration("window", 10*time.Second,
+		"time window of the call rates")
+	apdexT = flag.Duration("apdex-t", 5*time.Millisecond,
+		"APDEX target latency of the traced method")
+	sloLatency = flag.Duration("slo-latency", 0,
+		"SLO latency of the traced method (0 disables the SLO)")
+	sloTarget = flag.Float64("slo-target", 99,
+		"SLO objective: percentage of calls faster than the SLO latency")
+	signals = flag.Bool("signals", false,
+		"subscribe to the signals and the properties to count their emissions")
+	objects = flag.String("object", "",
+		"comma separated list of secondary objects to track (Service/ID)")
+	metricsListen = flag.String("metrics-listen", "",
+		"address where the metrics are served in the Prometheus format (e.g. :9100)")
+	headless = flag.Bool("headless", false,
+		"serve the metrics without the terminal UI (requires -metrics-listen)")
+	captureFile = flag.String("capture", "",
+		"replay a file produced by the capture command")
+	timeout = flag.Duration("timeout", 10*time.Second,
+		"age of the calls without response reported as stuck")
+	latencyWarning = flag.Duration("latency-warning", 10*time.Millisecond,
+		"latency from which the avg and max cells are yellow (0 disables it)")
+	latencyCritical = flag.Duration("latency-critical", 100*time.Millisecond,
+		"latency from which the avg and max cells are red (0 disables it)")
+	thresholdsFile = flag.String("thresholds", "",
+		"JSON file of per-service latency thresholds")
 )
 
 // widgets holds the widgets used by this demo.
@@ -70,10 +123,23 @@ type widgets struct {
 	logScroll   *text.Text
 	serviceInfo *text.Text
 	latencyPlot *linechart.LineChart
+	ratePlot    *linechart.LineChart
 	timePlot    *linechart.LineChart
 	sizePlot    *linechart.LineChart
 
+	latencyHisto *barchart.BarChart
+	debugScroll  *text.Text
+	payloadText  *text.Text
+	pendingText  *text.Text
+
+	// layout is the current layout.
+	layout layoutType
+	// bottom is the view displayed below the top list.
+	bottom bottomView
+
 	highlight *highlight
+	debug     *debugView
+	payloads  *payloadView
 	collector *collector
 	logger    *logger
 	info      *info
@@ -82,11 +148,30 @@ type widgets struct {
 func newLogScroll(ctx context.Context) (*text.Text, error) {
 	t, err := text.New(
 		text.RollContent(),
+		// page up/down navigate the top list.
 		text.ScrollKeys(
 			keyboard.KeyDelete,
 			keyboard.KeySpace,
-			keyboard.KeyPgUp,
-			keyboard.KeyPgDn,
+			keyboard.KeyCtrlU,
+			keyboard.KeyCtrlD,
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newTextView returns a text widget which does not roll: its first
+// lines stay visible.
+func newTextView(ctx context.Context) (*text.Text, error) {
+	t, err := text.New(
+		// page up/down navigate the top list.
+		text.ScrollKeys(
+			keyboard.KeyDelete,
+			keyboard.KeySpace,
+			keyboard.KeyCtrlU,
+			keyboard.KeyCtrlD,
 		),
 	)
 	if err != nil {
@@ -132,6 +217,17 @@ func newLatencyPlot(ctx context.Context) (*linechart.LineChart, error) {
 	}
 	return p, nil
 }
+func newRatePlot(ctx context.Context) (*linechart.LineChart, error) {
+	p, err := linechart.New(
+		linechart.YAxisFormattedValues(linechart.ValueFormatterRoundWithSuffix(" /s")),
+		linechart.AxesCellOpts(cell.FgColor(cell.ColorBlue)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 func newTimePlot(ctx context.Context) (*linechart.LineChart, error) {
 	p, err := linechart.New(
 		linechart.YAxisFormattedValues(linechart.ValueFormatterRoundWithSuffix(" µs")),
@@ -143,6 +239,24 @@ func newTimePlot(ctx context.Context) (*linechart.LineChart, error) {
 	return p, nil
 }
 
+func newLatencyHisto(ctx context.Context) (*barchart.BarChart, error) {
+	labels := latencyLabels()
+	colors := make([]cell.Color, len(labels))
+	for i := range colors {
+		colors[i] = cell.ColorYellow
+	}
+	h, err := barchart.New(
+		barchart.BarColors(colors),
+		barchart.ValueColors(colors),
+		barchart.Labels(labels),
+		barchart.BarGap(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
 // newWidgets creates all widgets used.
 func newWidgets(ctx context.Context, cancel context.CancelFunc, c *container.Container) (*widgets, error) {
 
@@ -170,13 +284,46 @@ func newWidgets(ctx context.Context, cancel context.CancelFunc, c *container.Con
 	if err != nil {
 		return nil, err
 	}
+	ratePlot, err := newRatePlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	latencyHisto, err := newLatencyHisto(ctx)
+	if err != nil {
+		return nil, err
+	}
+	debugScroll, err := newLogScroll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	debugDetail, err := newTextView(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payloadText, err := newTextView(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pendingText, err := newTextView(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &widgets{
 		topList:     topList,
 		logScroll:   logScroll,
 		serviceInfo: serviceInfo,
 		sizePlot:    sizePlot,
 		latencyPlot: latencyPlot,
+		ratePlot:    ratePlot,
 		timePlot:    timePlot,
+
+		latencyHisto: latencyHisto,
+		debugScroll:  debugScroll,
+		payloadText:  payloadText,
+		pendingText:  pendingText,
+
+		debug:    newDebugView(ctx, debugScroll, debugDetail),
+		payloads: newPayloadView(payloadText),
 	}, nil
 
 }
@@ -194,6 +341,29 @@ func gridLayout(w *widgets, layout layoutType) ([]container.Option, error) {
 			),
 		}
 	case layoutTopTraceLogs:
+		var bottom grid.Element
+		switch w.bottom {
+		case bottomDebug:
+			bottom = grid.Widget(w.debug.widget(),
+				container.Border(linestyle.Light),
+				container.BorderTitle("Debug: traces and logs"),
+			)
+		case bottomPayloads:
+			bottom = grid.Widget(w.payloadText,
+				container.Border(linestyle.Light),
+				container.BorderTitle("Payloads: arguments and responses"),
+			)
+		case bottomPending:
+			bottom = grid.Widget(w.pendingText,
+				container.Border(linestyle.Light),
+				container.BorderTitle(fmt.Sprintf("In-flight calls (stuck after %s)", *timeout)),
+			)
+		default:
+			bottom = grid.Widget(w.logScroll,
+				container.Border(linestyle.Light),
+				container.BorderTitle("Process logs"),
+			)
+		}
 		elements = []grid.Element{
 			grid.ColWidthPerc(50,
 				grid.RowHeightPerc(50,
@@ -202,27 +372,36 @@ func gridLayout(w *widgets, layout layoutType) ([]container.Option, error) {
 						container.BorderTitle("Most used methods"),
 					),
 				),
-				grid.RowHeightPerc(50,
-					grid.Widget(w.logScroll,
-						container.Border(linestyle.Light),
-						container.BorderTitle("Process logs"),
-					),
-				),
+				grid.RowHeightPerc(50, bottom),
 			),
 			grid.ColWidthPerc(50,
-				grid.RowHeightFixed(2,
+				grid.RowHeightFixed(8,
 					grid.Widget(w.serviceInfo,
 						container.Border(linestyle.None),
 					),
 				),
-				grid.RowHeightPerc(33,
+				grid.RowHeightPerc(20,
 					grid.Widget(w.latencyPlot,
 						container.Border(linestyle.Light),
 						container.BorderTitle("Latency (microseconds): reply (yellow), error (red)"),
 						container.BorderTitleAlignRight(),
 					),
 				),
-				grid.RowHeightPerc(33,
+				grid.RowHeightPerc(20,
+					grid.Widget(w.latencyHisto,
+						container.Border(linestyle.Light),
+						container.BorderTitle("Latency distribution"),
+						container.BorderTitleAlignRight(),
+					),
+				),
+				grid.RowHeightPerc(20,
+					grid.Widget(w.ratePlot,
+						container.Border(linestyle.Light),
+						container.BorderTitle("Calls per second: replies (green), errors (red)"),
+						container.BorderTitleAlignRight(),
+					),
+				),
+				grid.RowHeightPerc(20,
 					grid.Widget(w.timePlot,
 						container.Border(linestyle.Light),
 						container.BorderTitle("CPU time: user (green), system (yellow)"),
@@ -231,7 +410,7 @@ func gridLayout(w *widgets, layout layoutType) ([]container.Option, error) {
 						container.BorderColor(cell.ColorDefault),
 					),
 				),
-				grid.RowHeightPerc(33,
+				grid.RowHeightPerc(20,
 					grid.Widget(w.sizePlot,
 						container.Border(linestyle.Light),
 						container.BorderTitle("Messages: call size (green), response size (yellow)"),
@@ -257,6 +436,7 @@ func setLayout(c *container.Container, w *widgets, lt layoutType) error {
 	if err != nil {
 		return err
 	}
+	w.layout = lt
 	// remove border: else the previous container border is kept
 	c.Update(rootID, container.Border(linestyle.None))
 	return c.Update(rootID, gridOpts...)
@@ -273,13 +453,19 @@ func selectMethod(c *container.Container, w *widgets, service, method string) er
 		w.logger = nil
 	}
 
-	collector, err := newCollector(sess, w, service, method)
+	inspecting := w.debug.inspecting()
+	w.debug.reset()
+	if inspecting {
+		refreshBottom(c, w)
+	}
+	w.payloads.reset()
+	collector, err := newCollector(w, service, method)
 	if err != nil {
 		return err
 	}
-	logger, err := newLogger(sess, w, service, method)
+	logger, err := newLogger(w, service, method)
 	if err != nil {
-		log.Printf("failed to create logger: %s")
+		log.Printf("failed to create logger: %s", err)
 	}
 	info, err := newInfo(sess, w, service, method)
 	if err != nil {
@@ -291,6 +477,99 @@ func selectMethod(c *container.Container, w *widgets, service, method string) er
 	return nil
 }
 
+// toggleBottom switches between the logs and a view below the top
+// list.
+func toggleBottom(c *container.Container, w *widgets, view bottomView) {
+	if w.bottom == view {
+		w.bottom = bottomLogs
+	} else {
+		w.bottom = view
+	}
+	w.payloads.show(w.bottom == bottomPayloads)
+	refreshBottom(c, w)
+}
+
+// refreshBottom places the widget of the view below the top list: the
+// debug view changes its widget when a slow call is inspected.
+func refreshBottom(c *container.Container, w *widgets) {
+	if w.layout == layoutTopTraceLogs {
+		setLayout(c, w, w.layout)
+	}
+}
+
+// debugKeyboard handles the controls of the views below the top list.
+func debugKeyboard(c *container.Container, w *widgets, k *terminalapi.Keyboard) {
+	switch k.Key {
+	case 'd':
+		toggleBottom(c, w, bottomDebug)
+	case 'v':
+		toggleBottom(c, w, bottomPayloads)
+	case 'i':
+		toggleBottom(c, w, bottomPending)
+	case 'n':
+		if w.bottom == bottomDebug {
+			w.debug.inspect(-1)
+			refreshBottom(c, w)
+		} else if w.bottom == bottomPayloads {
+			w.payloads.step(-1)
+		}
+	case 'N':
+		if w.bottom == bottomDebug {
+			w.debug.inspect(1)
+			refreshBottom(c, w)
+		} else if w.bottom == bottomPayloads {
+			w.payloads.step(1)
+		}
+	}
+}
+
+// traceKeyboard handles the controls of the traced methods.
+func traceKeyboard(w *widgets, k *terminalapi.Keyboard) {
+	if w.collector == nil {
+		return
+	}
+	switch k.Key {
+	case 'm':
+		w.collector.cycle(1)
+	case 'M':
+		w.collector.cycle(-1)
+	case 'S':
+		w.collector.toggleStack()
+	default:
+		return
+	}
+	w.collector.updateUI(w)
+}
+
+// replayKeyboard handles the replay controls.
+func replayKeyboard(c *container.Container, w *widgets, p *player, k *terminalapi.Keyboard) {
+	offset := time.Duration(0)
+	switch k.Key {
+	case 'p':
+		p.togglePause()
+	case '+':
+		p.setSpeed(2)
+	case '-':
+		p.setSpeed(0.5)
+	case 'f':
+		offset = replayStep
+	case 'b':
+		offset = -replayStep
+	}
+	if offset == 0 {
+		return
+	}
+	// the subscriptions are closed when rewinding: select again
+	// the traced method to follow the replay.
+	if p.seek(offset) && w.collector != nil {
+		service, method := w.collector.selected()
+		err := selectMethod(c, w, service, method)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
 func run() (err error) {
 
 	if *level < 0 || *level > 6 {
@@ -298,9 +577,32 @@ func run() (err error) {
 	}
 	logLevel = qilog.LogLevel{Level: int32(*level)}
 
-	sess, err = app.SessionFromFlag()
-	if err != nil {
-		return err
+	if *apdexT <= 0 {
+		return fmt.Errorf("invalid APDEX target: %s", *apdexT)
+	}
+	if *sloTarget <= 0 || *sloTarget >= 100 {
+		return fmt.Errorf("invalid SLO objective: %g%%", *sloTarget)
+	}
+
+	var replay *player
+	if *replayFile != "" {
+		replay, err = loadPlayer(*replayFile)
+		if err != nil {
+			return err
+		}
+		input = replay
+	} else if *captureFile != "" {
+		replay, err = loadCapture(*captureFile)
+		if err != nil {
+			return err
+		}
+		input = replay
+	} else {
+		sess, err = app.SessionFromFlag()
+		if err != nil {
+			return err
+		}
+		input = liveSource{sess}
 	}
 
 	t, err := termbox.New(termbox.ColorMode(terminalapi.ColorMode256))
@@ -321,7 +623,10 @@ func run() (err error) {
 	defer log.SetOutput(log.Writer())
 	log.SetOutput(logger)
 
-	c, err := container.New(t, container.ID(rootID))
+	// the panels are focused by a click: their border is then
+	// highlighted.
+	c, err := container.New(t, container.ID(rootID),
+		container.FocusedColor(cell.ColorYellow))
 	if err != nil {
 		return err
 	}
@@ -334,13 +639,27 @@ func run() (err error) {
 		return err
 	}
 
+	if replay != nil {
+		go replay.run(ctx)
+	}
+
 	w.highlight, err = newHighlighter(ctx, cancel, c, w)
 	if err != nil {
 		return err
 	}
 
-	if *service != "" && *method != "" {
-		selectMethod(c, w, *service, *method)
+	if *metricsListen != "" {
+		go func() {
+			err := serveMetrics(ctx, *metricsListen, w.highlight.statistics)
+			if err != nil {
+				mainErr = err
+				cancel()
+			}
+		}()
+	}
+
+	if *service != "" {
+		err = selectMethod(c, w, *service, *method)
 		if err != nil {
 			return err
 		}
@@ -352,14 +671,45 @@ func run() (err error) {
 		return err
 	}
 
-	quitter := func(k *terminalapi.Keyboard) {
+	// keys dispatches the keyboard events: the search prompt of the
+	// top list has precedence over the shortcuts.
+	keys := func(k *terminalapi.Keyboard) {
+		if k.Key == keyboard.KeyCtrlC {
+			cancel()
+			return
+		}
+		if w.topList.Searching() ||
+			(k.Key == keyboard.KeyEsc && w.topList.Filtered()) {
+			w.topList.Keyboard(k, nil)
+			return
+		}
+		if k.Key == keyboard.KeyEsc && w.bottom == bottomDebug && w.debug.inspecting() {
+			w.debug.follow()
+			refreshBottom(c, w)
+			return
+		}
+		if k.Key == keyboard.KeyEsc && w.bottom == bottomPayloads && w.payloads.selecting() {
+			w.payloads.follow()
+			return
+		}
 		switch k.Key {
-		case keyboard.KeyEsc, keyboard.KeyCtrlC, 'q':
+		case keyboard.KeyEsc, 'q':
 			cancel()
+			return
+		}
+		err := w.topList.Keyboard(k, nil)
+		if err != nil {
+			log.Print(err)
+		}
+		w.highlight.keyboard(k)
+		debugKeyboard(c, w, k)
+		traceKeyboard(w, k)
+		if replay != nil {
+			replayKeyboard(c, w, replay, k)
 		}
 	}
 
-	if err := termdash.Run(ctx, t, c, termdash.KeyboardSubscriber(quitter),
+	if err := termdash.Run(ctx, t, c, termdash.KeyboardSubscriber(keys),
 		termdash.RedrawInterval(redrawInterval)); err != nil {
 		return err
 	}
@@ -377,7 +727,37 @@ func main() {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	if err := run(); err != nil {
+	var err error
+	secondaryObjects, err = parseObjects(*objects)
+	if err != nil {
+		log.Fatal(err)
+	}
+	thresholds, err = loadThresholds(*thresholdsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch flag.Arg(0) {
+	case "":
+		if *headless {
+			if *metricsListen == "" {
+				log.Fatal("-headless requires -metrics-listen")
+			}
+			err = runHeadless()
+		} else {
+			err = run()
+		}
+	case "record":
+		err = runRecord(flag.Args()[1:])
+	case "diff":
+		err = runDiff(flag.Args()[1:])
+	case "timeline":
+		err = runTimeline(flag.Args()[1:])
+	case "capture":
+		err = runCapture(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown command: %s", flag.Arg(0))
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 	if mainErr != nil {
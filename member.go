@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// memberKind tells apart the methods, the signals and the properties
+// of a service.
+type memberKind int
+
+const (
+	memberMethod memberKind = iota
+	memberSignal
+	memberProperty
+)
+
+// traceSignal is the kind of the trace events of the signal and
+// property emissions (Event_Signal in libqi).
+const traceSignal = 4
+
+// String returns the marker displayed after the signals and the
+// properties.
+func (k memberKind) String() string {
+	switch k {
+	case memberSignal:
+		return "signal"
+	case memberProperty:
+		return "property"
+	default:
+		return "method"
+	}
+}
+
+// parseMemberKind is the reverse of memberKind.String.
+func parseMemberKind(s string) memberKind {
+	switch s {
+	case "signal":
+		return memberSignal
+	case "property":
+		return memberProperty
+	default:
+		return memberMethod
+	}
+}
+
+// member returns the name and the kind of a slot.
+func member(meta object.MetaObject, slot uint32) (string, memberKind, bool) {
+	if m, ok := meta.Methods[slot]; ok {
+		return m.Name, memberMethod, true
+	}
+	if s, ok := meta.Signals[slot]; ok {
+		return s.Name, memberSignal, true
+	}
+	if p, ok := meta.Properties[slot]; ok {
+		return p.Name, memberProperty, true
+	}
+	return fmt.Sprintf("%d", slot), memberMethod, false
+}
+
+// traffic counts the emissions of a signal or a property.
+type traffic struct {
+	count uint32
+	bytes uint64
+}
+
+// size returns the average payload size in bytes.
+func (t traffic) size() float64 {
+	if t.count == 0 {
+		return 0
+	}
+	return float64(t.bytes) / float64(t.count)
+}
+
+// subscribeMembers counts the emissions of the signals and the
+// properties of a service. It returns a function to unsubscribe. The
+// subscribers are not counted: the statistics of a service do not tell
+// which signal a registerEvent call subscribes to.
+func (h *highlight) subscribeMembers(serviceName string, obj bus.ObjectProxy, meta object.MetaObject) func() {
+	cancels := []func(){}
+	subscribe := func(id uint32, a action) {
+		cancel, payloads, err := obj.Proxy().SubscribeID(id)
+		if err != nil {
+			log.Printf("failed to subscribe %s: %s", a, err)
+			return
+		}
+		cancels = append(cancels, cancel)
+		go func() {
+			for payload := range payloads {
+				h.servicesMutex.Lock()
+				if _, ok := h.services[serviceName]; !ok {
+					// removed while the payload was in flight
+					h.servicesMutex.Unlock()
+					continue
+				}
+				t := h.traffic[a]
+				t.count++
+				t.bytes += uint64(len(payload))
+				h.traffic[a] = t
+				h.servicesMutex.Unlock()
+			}
+		}()
+	}
+	for id, s := range meta.Signals {
+		subscribe(id, action{serviceName, s.Name, memberSignal})
+	}
+	for id, p := range meta.Properties {
+		subscribe(id, action{serviceName, p.Name, memberProperty})
+	}
+	return func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
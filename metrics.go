@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/lugu/qiloop/app"
+	"github.com/lugu/qiloop/bus"
+)
+
+// metric describes a value exported for every method.
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(s bus.MethodStatistics) float64
+}
+
+var methodMetrics = []metric{
+	{"qitop_calls_total", "counter", "Number of calls.",
+		func(s bus.MethodStatistics) float64 { return float64(s.Count) }},
+	{"qitop_wall_seconds_total", "counter", "Cumulated wall time of the calls.",
+		func(s bus.MethodStatistics) float64 { return float64(s.Wall.CumulatedValue) }},
+	{"qitop_user_seconds_total", "counter", "Cumulated user CPU time of the calls.",
+		func(s bus.MethodStatistics) float64 { return float64(s.User.CumulatedValue) }},
+	{"qitop_system_seconds_total", "counter", "Cumulated system CPU time of the calls.",
+		func(s bus.MethodStatistics) float64 { return float64(s.System.CumulatedValue) }},
+	{"qitop_wall_min_seconds", "gauge", "Minimum wall time of a call.",
+		func(s bus.MethodStatistics) float64 { return float64(s.Wall.MinValue) }},
+	{"qitop_wall_max_seconds", "gauge", "Maximum wall time of a call.",
+		func(s bus.MethodStatistics) float64 { return float64(s.Wall.MaxValue) }},
+}
+
+var emissionMetric = metric{"qitop_emissions_total", "counter",
+	"Number of emissions of the signals and the properties.",
+	func(s bus.MethodStatistics) float64 { return float64(s.Count) }}
+
+// escapeLabel escapes a label value of the exposition format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeMetrics writes the statistics in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer, stats map[action]bus.MethodStatistics) error {
+	methods := make([]action, 0, len(stats))
+	members := make([]action, 0)
+	for a := range stats {
+		if a.kind == memberMethod {
+			methods = append(methods, a)
+		} else {
+			members = append(members, a)
+		}
+	}
+	byName := func(actions []action) {
+		sort.Slice(actions, func(i, j int) bool {
+			return actions[i].String() < actions[j].String()
+		})
+	}
+	byName(methods)
+	byName(members)
+
+	write := func(m metric, actions []action) error {
+		if len(actions) == 0 {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n",
+			m.name, m.help, m.name, m.kind)
+		if err != nil {
+			return err
+		}
+		for _, a := range actions {
+			labels := fmt.Sprintf(`service="%s",method="%s"`,
+				escapeLabel(a.service), escapeLabel(a.method))
+			if a.kind != memberMethod {
+				labels += fmt.Sprintf(`,kind="%s"`, a.kind)
+			}
+			_, err = fmt.Fprintf(w, "%s{%s} %g\n", m.name, labels,
+				m.value(stats[a]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, m := range methodMetrics {
+		if err := write(m, methods); err != nil {
+			return err
+		}
+	}
+	return write(emissionMetric, members)
+}
+
+// serveMetrics exports the statistics on addr until the context
+// expires.
+func serveMetrics(ctx context.Context, addr string, statistics func() (map[action]bus.MethodStatistics, error)) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := statistics()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err = writeMetrics(w, stats)
+		if err != nil {
+			log.Printf("metrics: %s", err)
+		}
+	})
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return server.Shutdown(context.Background())
+	}
+}
+
+// runHeadless exports the metrics without the terminal UI.
+func runHeadless() (err error) {
+	sess, err = app.SessionFromFlag()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(0)
+	defer cancel()
+
+	h := newHighlight(*window)
+	err = h.initServices(ctx, sess, cancel)
+	if err != nil {
+		return err
+	}
+	return serveMetrics(ctx, *metricsListen, h.statistics)
+}
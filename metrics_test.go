@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/lugu/qiloop/bus"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats map[action]bus.MethodStatistics
+		want  []string
+	}{
+		{"empty", map[action]bus.MethodStatistics{}, nil},
+		{"method", map[action]bus.MethodStatistics{
+			{"A", "m", memberMethod}: {
+				Count:  2,
+				Wall:   bus.MinMaxSum{MinValue: 0.125, MaxValue: 0.375, CumulatedValue: 0.5},
+				User:   bus.MinMaxSum{CumulatedValue: 0.25},
+				System: bus.MinMaxSum{CumulatedValue: 0.125},
+			},
+		}, []string{
+			"# HELP qitop_calls_total Number of calls.",
+			"# TYPE qitop_calls_total counter",
+			`qitop_calls_total{service="A",method="m"} 2`,
+			"# HELP qitop_wall_seconds_total Cumulated wall time of the calls.",
+			"# TYPE qitop_wall_seconds_total counter",
+			`qitop_wall_seconds_total{service="A",method="m"} 0.5`,
+			"# HELP qitop_user_seconds_total Cumulated user CPU time of the calls.",
+			"# TYPE qitop_user_seconds_total counter",
+			`qitop_user_seconds_total{service="A",method="m"} 0.25`,
+			"# HELP qitop_system_seconds_total Cumulated system CPU time of the calls.",
+			"# TYPE qitop_system_seconds_total counter",
+			`qitop_system_seconds_total{service="A",method="m"} 0.125`,
+			"# HELP qitop_wall_min_seconds Minimum wall time of a call.",
+			"# TYPE qitop_wall_min_seconds gauge",
+			`qitop_wall_min_seconds{service="A",method="m"} 0.125`,
+			"# HELP qitop_wall_max_seconds Maximum wall time of a call.",
+			"# TYPE qitop_wall_max_seconds gauge",
+			`qitop_wall_max_seconds{service="A",method="m"} 0.375`,
+		}},
+		{"signal and property", map[action]bus.MethodStatistics{
+			{"B", "value", memberProperty}: {Count: 1},
+			{"A", "changed", memberSignal}: {Count: 3},
+		}, []string{
+			"# HELP qitop_emissions_total Number of emissions of the signals and the properties.",
+			"# TYPE qitop_emissions_total counter",
+			`qitop_emissions_total{service="A",method="changed",kind="signal"} 3`,
+			`qitop_emissions_total{service="B",method="value",kind="property"} 1`,
+		}},
+		{"escaping", map[action]bus.MethodStatistics{
+			{"a\\b\"c\n", "m", memberSignal}: {Count: 1},
+		}, []string{
+			"# HELP qitop_emissions_total Number of emissions of the signals and the properties.",
+			"# TYPE qitop_emissions_total counter",
+			`qitop_emissions_total{service="a\\b\"c\n",method="m",kind="signal"} 1`,
+		}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeMetrics(&buf, test.stats); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		want := ""
+		if test.want != nil {
+			want = strings.Join(test.want, "\n") + "\n"
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
+
+func TestWriteMetricsGrouping(t *testing.T) {
+	stats := map[action]bus.MethodStatistics{
+		{"B", "b", memberMethod}:    {Count: 1},
+		{"A", "a", memberMethod}:    {Count: 2},
+		{"A", "s", memberSignal}:    {Count: 3},
+		{"C", "p", memberProperty}:  {Count: 4},
+		{"A/2", "a", memberMethod}:  {Count: 5},
+		{"A", "a2", memberMethod}:   {Count: 6},
+		{"B", "s2", memberSignal}:   {Count: 7},
+		{"C", "p2", memberProperty}: {Count: 8},
+	}
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	// every sample follows the HELP and TYPE lines of its metric,
+	// which are written once.
+	seen := map[string]bool{}
+	current := ""
+	samples := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			current = strings.Fields(line)[2]
+			if seen[current] {
+				t.Errorf("%s: HELP written twice", current)
+			}
+			seen[current] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			if name := strings.Fields(line)[2]; name != current {
+				t.Errorf("TYPE of %s after the HELP of %s", name, current)
+			}
+			continue
+		}
+		name := line[:strings.Index(line, "{")]
+		if name != current {
+			t.Errorf("sample %q in the group of %s", line, current)
+		}
+		samples[name]++
+	}
+	if len(seen) != len(methodMetrics)+1 {
+		t.Errorf("got %d metrics, want %d", len(seen), len(methodMetrics)+1)
+	}
+	for _, m := range methodMetrics {
+		if samples[m.name] != 4 {
+			t.Errorf("%s: got %d samples, want 4", m.name, samples[m.name])
+		}
+	}
+	if n := samples[emissionMetric.name]; n != 4 {
+		t.Errorf("%s: got %d samples, want 4", emissionMetric.name, n)
+	}
+}
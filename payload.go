@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+// maxPayloads is the number of calls kept by the payload view.
+const maxPayloads = 50
+
+// payload holds the arguments and the response of a call.
+type payload struct {
+	meta      object.MetaMethod
+	timestamp time.Time
+	duration  time.Duration
+	kind      uint8
+	arguments value.Value
+	response  value.Value
+}
+
+func newPayload(meta object.MetaMethod, call, response bus.EventTrace, evt callEvent) payload {
+	return payload{
+		meta:      meta,
+		timestamp: evt.timestamp,
+		duration:  evt.duration,
+		kind:      uint8(response.Kind),
+		arguments: call.Arguments,
+		response:  response.Arguments,
+	}
+}
+
+// prototype returns the signature of the method with the names of its
+// parameters.
+func (p payload) prototype() string {
+	names := make([]string, len(p.meta.Parameters))
+	for i, param := range p.meta.Parameters {
+		names[i] = param.Name
+	}
+	return fmt.Sprintf("%s(%s) %s -> %s", p.meta.Name,
+		strings.Join(names, ", "), p.meta.ParametersSignature,
+		p.meta.ReturnSignature)
+}
+
+// formatValue returns the decoded value followed by its signature.
+func formatValue(v value.Value) string {
+	if v == nil {
+		return "<none>"
+	}
+	return fmt.Sprintf("%v (signature: %s)", v, v.Signature())
+}
+
+// payloadView displays the arguments and the responses of the last
+// calls of the traced service.
+type payloadView struct {
+	display *text.Text
+
+	mutex    sync.Mutex
+	payloads []payload
+	// selected is the index in payloads of the displayed call. -1
+	// when following the last call.
+	selected int
+	// shown is true when the view is displayed. Otherwise, the
+	// new calls are drawn when it is shown again.
+	shown bool
+	stale bool
+}
+
+func newPayloadView(display *text.Text) *payloadView {
+	return &payloadView{
+		display:  display,
+		payloads: []payload{},
+		selected: -1,
+	}
+}
+
+func (v *payloadView) reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.payloads = v.payloads[:0]
+	v.selected = -1
+	v.updateUI()
+}
+
+func (v *payloadView) add(p payload) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.payloads = append(v.payloads, p)
+	if len(v.payloads) > 2*maxPayloads {
+		drop := len(v.payloads) - maxPayloads
+		v.payloads = v.payloads[drop:]
+		v.selected -= drop
+		if v.selected < 0 {
+			v.selected = -1
+		}
+	}
+	if v.selected != -1 {
+		return
+	}
+	if v.shown {
+		v.updateUI()
+	} else {
+		v.stale = true
+	}
+}
+
+// show records whether the view is displayed.
+func (v *payloadView) show(shown bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.shown = shown
+	if shown && v.stale {
+		v.updateUI()
+	}
+}
+
+// step selects the previous (-1) or the next (1) call.
+func (v *payloadView) step(step int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if len(v.payloads) == 0 {
+		return
+	}
+	i := v.selected
+	if i == -1 {
+		i = len(v.payloads) - 1
+	}
+	i += step
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(v.payloads)-1 {
+		i = -1
+	}
+	v.selected = i
+	v.updateUI()
+}
+
+// follow selects the last call.
+func (v *payloadView) follow() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.selected = -1
+	v.updateUI()
+}
+
+// selecting returns true when a call other than the last one is
+// displayed.
+func (v *payloadView) selecting() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.selected != -1
+}
+
+// updateUI displays the payload of the selected call followed by the
+// list of the last calls. Must be called with the mutex held.
+func (v *payloadView) updateUI() {
+	v.stale = false
+	v.display.Reset()
+	if len(v.payloads) == 0 {
+		v.display.Write("No call traced yet.\n")
+		return
+	}
+	selected := v.selected
+	if selected == -1 {
+		selected = len(v.payloads) - 1
+	}
+	p := v.payloads[selected]
+	response := "reply"
+	color := cell.ColorDefault
+	if p.kind == net.Error {
+		response = "error"
+		color = cell.ColorRed
+	}
+	v.display.Write(fmt.Sprintf("%s\n", p.prototype()),
+		text.WriteCellOpts(cell.FgColor(cell.ColorYellow)))
+	v.display.Write(fmt.Sprintf("arguments: %s\n", formatValue(p.arguments)))
+	v.display.Write(fmt.Sprintf("%s: %s\n", response, formatValue(p.response)),
+		text.WriteCellOpts(cell.FgColor(color)))
+	v.display.Write("\nLast calls (n: older, N: newer, esc: follow):\n",
+		text.WriteCellOpts(cell.FgColor(cell.ColorCyan)))
+	start := 0
+	if len(v.payloads) > maxPayloads {
+		start = len(v.payloads) - maxPayloads
+	}
+	for i := len(v.payloads) - 1; i >= start; i-- {
+		p := v.payloads[i]
+		opts := []cell.Option{}
+		if i == selected {
+			opts = append(opts, cell.FgColor(cell.ColorYellow))
+		} else if p.kind == net.Error {
+			opts = append(opts, cell.FgColor(cell.ColorRed))
+		}
+		v.display.Write(fmt.Sprintf("%s %s %s\n",
+			p.timestamp.Format("15:04:05.000"), p.meta.Name, p.duration),
+			text.WriteCellOpts(opts...))
+	}
+}
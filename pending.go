@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/mum4k/termdash/cell"
+	"github.com/mum4k/termdash/widgets/text"
+)
+
+const (
+	// pendingInterval is how often the in-flight calls are checked.
+	pendingInterval = time.Second
+
+	// maxPending is the number of events kept waiting for their
+	// pair. The oldest ones are evicted.
+	maxPending = 1000
+
+	// maxPendingAge is the age after which an event waiting for its
+	// pair is evicted.
+	maxPendingAge = 10 * time.Minute
+)
+
+// inFlight is a call waiting for its response.
+type inFlight struct {
+	id     uint32
+	method string
+	age    time.Duration
+}
+
+// inFlightCalls returns the calls waiting for a response, the oldest
+// first. Must be called with the mutex held.
+func (c *collector) inFlightCalls(now time.Time) []inFlight {
+	calls := make([]inFlight, 0, len(c.pending))
+	for id, e := range c.pending {
+		if e.Kind != int32(net.Call) {
+			continue
+		}
+		calls = append(calls, inFlight{
+			id:     id,
+			method: c.methodName(e.SlotId),
+			age:    now.Sub(c.arrivals[id]),
+		})
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].age > calls[j].age
+	})
+	return calls
+}
+
+// addPending records the arrival of an event waiting for its pair.
+// Must be called with the mutex held.
+func (c *collector) addPending(e bus.EventTrace) {
+	if _, ok := c.pending[e.Id]; ok {
+		c.arrivals[e.Id] = c.now()
+	} else {
+		delete(c.arrivals, e.Id)
+	}
+}
+
+// evict drops the events waiting for too long: their pair has been
+// lost. Must be called with the mutex held.
+func (c *collector) evict(now time.Time) {
+	for id, arrival := range c.arrivals {
+		if now.Sub(arrival) > maxPendingAge {
+			delete(c.pending, id)
+			delete(c.arrivals, id)
+			c.evicted++
+		}
+	}
+	if len(c.pending) <= maxPending {
+		return
+	}
+	ids := make([]uint32, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return c.arrivals[ids[i]].Before(c.arrivals[ids[j]])
+	})
+	for _, id := range ids[:len(ids)-maxPending] {
+		delete(c.pending, id)
+		delete(c.arrivals, id)
+		c.evicted++
+	}
+}
+
+// pendingDetail counts the in-flight calls for the info panel.
+func pendingDetail(calls []inFlight, evicted int) detail {
+	stuck := 0
+	for _, call := range calls {
+		if call.age > *timeout {
+			stuck++
+		}
+	}
+	d := detail{
+		text: fmt.Sprintf("In-flight: %d, stuck: %d, evicted: %d (i: list)",
+			len(calls), stuck, evicted),
+		color: cell.ColorDefault,
+	}
+	if stuck != 0 {
+		d.color = cell.ColorRed
+	}
+	return d
+}
+
+// updatePending evicts the stale events and displays the in-flight
+// calls. Must be called with the mutex held.
+func (c *collector) updatePending(w *widgets) []inFlight {
+	now := c.now()
+	c.evict(now)
+	calls := c.inFlightCalls(now)
+	w.pendingText.Reset()
+	if len(calls) == 0 {
+		w.pendingText.Write("No call in flight.\n")
+		return calls
+	}
+	for _, call := range calls {
+		line := fmt.Sprintf("%10s %s (id: %d)", call.age.Truncate(time.Millisecond),
+			call.method, call.id)
+		if call.age > *timeout {
+			w.pendingText.Write(line+" stuck\n",
+				text.WriteCellOpts(cell.FgColor(cell.ColorRed)))
+		} else {
+			w.pendingText.Write(line + "\n")
+		}
+	}
+	return calls
+}
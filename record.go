@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/app"
+	"github.com/lugu/qiloop/bus"
+	qilog "github.com/lugu/qiloop/bus/logger"
+	"github.com/lugu/qiloop/type/value"
+)
+
+// Kinds of record. Records without kind are method statistics.
+const (
+	recordStats = ""
+	recordTrace = "trace"
+	recordLog   = "log"
+)
+
+// record is a line of the file produced by the record mode: the
+// statistics of a method, a trace event or a log message received
+// at a given time.
+type record struct {
+	Kind    string       `json:"kind,omitempty"`
+	Time    time.Time    `json:"time"`
+	Service string       `json:"service"`
+	Method  string       `json:"method,omitempty"`
+	Member  string       `json:"member,omitempty"`
+	Count   uint32       `json:"count,omitempty"`
+	WallMin float64      `json:"wall_min_us,omitempty"`
+	WallMax float64      `json:"wall_max_us,omitempty"`
+	WallAvg float64      `json:"wall_avg_us,omitempty"`
+	UserAvg float64      `json:"user_avg_us,omitempty"`
+	SysAvg  float64      `json:"system_avg_us,omitempty"`
+	SizeAvg float64      `json:"size_avg,omitempty"`
+	Trace   *traceRecord `json:"trace,omitempty"`
+	Log     *logRecord   `json:"log,omitempty"`
+}
+
+// traceRecord is the serialized form of a bus.EventTrace.
+type traceRecord struct {
+	ID            uint32 `json:"id"`
+	Kind          int32  `json:"kind"`
+	SlotID        uint32 `json:"slot"`
+	Arguments     []byte `json:"args"`
+	Sec           int64  `json:"sec"`
+	Usec          int64  `json:"usec"`
+	UserUsTime    int64  `json:"user_us"`
+	SystemUsTime  int64  `json:"system_us"`
+	CallerContext uint32 `json:"caller"`
+	CalleeContext uint32 `json:"callee"`
+}
+
+func newTraceRecord(e bus.EventTrace) *traceRecord {
+	return &traceRecord{
+		ID:            e.Id,
+		Kind:          e.Kind,
+		SlotID:        e.SlotId,
+		Arguments:     value.Bytes(e.Arguments),
+		Sec:           e.Timestamp.Tv_sec,
+		Usec:          e.Timestamp.Tv_usec,
+		UserUsTime:    e.UserUsTime,
+		SystemUsTime:  e.SystemUsTime,
+		CallerContext: e.CallerContext,
+		CalleeContext: e.CalleeContext,
+	}
+}
+
+func (t *traceRecord) event() (bus.EventTrace, error) {
+	args, err := value.NewValue(bytes.NewReader(t.Arguments))
+	if err != nil {
+		return bus.EventTrace{}, fmt.Errorf("trace arguments: %s", err)
+	}
+	return bus.EventTrace{
+		Id:        t.ID,
+		Kind:      t.Kind,
+		SlotId:    t.SlotID,
+		Arguments: args,
+		Timestamp: bus.Timeval{
+			Tv_sec:  t.Sec,
+			Tv_usec: t.Usec,
+		},
+		UserUsTime:    t.UserUsTime,
+		SystemUsTime:  t.SystemUsTime,
+		CallerContext: t.CallerContext,
+		CalleeContext: t.CalleeContext,
+	}, nil
+}
+
+// logRecord is the serialized form of a log message.
+type logRecord struct {
+	Level    int32  `json:"level"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+	Date     uint64 `json:"date,omitempty"`
+}
+
+func newLogRecord(m qilog.LogMessage) *logRecord {
+	return &logRecord{
+		Level:    m.Level.Level,
+		Category: m.Category,
+		Message:  m.Message,
+		Date:     m.SystemDate.Ns,
+	}
+}
+
+func (l *logRecord) message() qilog.LogMessage {
+	return qilog.LogMessage{
+		Level:    qilog.LogLevel{Level: l.Level},
+		Category: l.Category,
+		Message:  l.Message,
+		SystemDate: qilog.TimePoint{
+			Ns: l.Date,
+		},
+	}
+}
+
+// recorder serializes the records written by concurrent goroutines.
+type recorder struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func (r *recorder) write(rec record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.encoder.Encode(rec)
+}
+
+// recordTrace writes the trace events and the logs of a service
+// until the context expires.
+func (r *recorder) recordTrace(ctx context.Context, src source, service string) error {
+	meta, cancelTrace, events, err := src.trace(service)
+	if err != nil {
+		return err
+	}
+	cancelLogs, logs, err := src.logs(service)
+	if err != nil {
+		cancelTrace()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		cancelTrace()
+		cancelLogs()
+	}()
+	go func() {
+		for e := range events {
+			rec := record{
+				Kind:    recordTrace,
+				Time:    time.Now(),
+				Service: service,
+				Trace:   newTraceRecord(e),
+			}
+			if m, ok := meta.Methods[e.SlotId]; ok {
+				rec.Method = m.Name
+			}
+			if err := r.write(rec); err != nil {
+				log.Print(err)
+			}
+		}
+	}()
+	go func() {
+		for msgs := range logs {
+			for _, m := range msgs {
+				err := r.write(record{
+					Kind:    recordLog,
+					Time:    time.Now(),
+					Service: service,
+					Log:     newLogRecord(m),
+				})
+				if err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func newRecord(now time.Time, e entry) record {
+	member := ""
+	if e.action.kind != memberMethod {
+		member = e.action.kind.String()
+	}
+	return record{
+		Time:    now,
+		Service: e.action.service,
+		Method:  e.action.method,
+		Member:  member,
+		Count:   e.count.Count,
+		WallMin: float64(e.count.Wall.MinValue) * 1000000.0,
+		WallMax: float64(e.count.Wall.MaxValue) * 1000000.0,
+		WallAvg: e.value(sortAvg) * 1000000.0,
+		UserAvg: e.value(sortUserAvg) * 1000000.0,
+		SysAvg:  e.value(sortSystemAvg) * 1000000.0,
+		SizeAvg: e.size,
+	}
+}
+
+// commandContext returns the context of a command without terminal
+// UI: it is canceled on interrupt (ctrl-c) and after duration when
+// duration is not zero.
+func commandContext(duration time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), duration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		defer signal.Stop(interrupt)
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// runRecord implements the record command: it periodically writes
+// the method statistics of all the services without the terminal
+// UI.
+func runRecord(args []string) (err error) {
+
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	output := flags.String("o", "-", "output file (- for stdout)")
+	interval := flags.Duration("interval", time.Second, "sampling interval")
+	duration := flags.Duration("duration", 0,
+		"recording duration (0 records until interrupted)")
+	traced := flags.String("trace", "",
+		"comma separated list of services whose traces and logs are recorded")
+	flags.Parse(args)
+
+	if *interval <= 0 {
+		return fmt.Errorf("invalid interval: %s", *interval)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	sess, err = app.SessionFromFlag()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(*duration)
+	defer cancel()
+
+	h := newHighlight(*interval)
+	err = h.initServices(ctx, sess, cancel)
+	if err != nil {
+		return err
+	}
+	updater, err := h.updater(ctx, sess, cancel)
+	if err != nil {
+		return err
+	}
+
+	r := &recorder{
+		encoder: json.NewEncoder(out),
+	}
+	if *traced != "" {
+		for _, service := range strings.Split(*traced, ",") {
+			err = r.recordTrace(ctx, liveSource{sess}, service)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			entries, err := updater()
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				err = r.write(newRecord(now, e))
+				if err != nil {
+					return err
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
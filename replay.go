@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	qilog "github.com/lugu/qiloop/bus/logger"
+	"github.com/lugu/qiloop/type/object"
+)
+
+const (
+	// replayInterval is how often the replay position is updated.
+	replayInterval = 100 * time.Millisecond
+
+	// replayStep is the offset of a seek.
+	replayStep = 10 * time.Second
+
+	// replayBuffer is the capacity of the subscription channels.
+	replayBuffer = 100
+)
+
+// player replays a file produced by the record command. It
+// implements source for the trace events and the logs and provides
+// the method statistics of the top list.
+type player struct {
+	records []record
+	metas   map[string]object.MetaObject
+
+	mutex            sync.Mutex
+	position         time.Time
+	next             int
+	speed            float64
+	paused           bool
+	stats            map[action]bus.MethodStatistics
+	payloadSizes     map[action]float64
+	traceSubscribers map[*replayQueue]string
+	logSubscribers   map[*replayQueue]string
+}
+
+// replayQueue holds the records of a subscriber until they are read:
+// the replay neither waits for a slow subscriber nor drops its
+// records.
+type replayQueue struct {
+	mutex   sync.Mutex
+	records []record
+	// ready is signaled when records are queued. done is closed
+	// when the subscription ends.
+	ready chan struct{}
+	done  chan struct{}
+}
+
+func newReplayQueue() *replayQueue {
+	return &replayQueue{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// push queues a record without blocking.
+func (q *replayQueue) push(r record) {
+	q.mutex.Lock()
+	q.records = append(q.records, r)
+	q.mutex.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the subscription. Must be called once.
+func (q *replayQueue) stop() {
+	close(q.done)
+}
+
+// run passes the queued records to send until the subscription ends
+// or send returns false.
+func (q *replayQueue) run(send func(record) bool) {
+	for {
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return
+		}
+		q.mutex.Lock()
+		records := q.records
+		q.records = nil
+		q.mutex.Unlock()
+		for _, r := range records {
+			if !send(r) {
+				return
+			}
+		}
+	}
+}
+
+// loadPlayer reads a recording. The records are sorted by time.
+func loadPlayer(filename string) (*player, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]record, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, line, err)
+		}
+		if r.Kind == recordTrace && r.Trace == nil {
+			return nil, fmt.Errorf("%s:%d: trace record without trace", filename, line)
+		}
+		if r.Kind == recordLog && r.Log == nil {
+			return nil, fmt.Errorf("%s:%d: log record without log", filename, line)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: empty recording", filename)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return newPlayer(records), nil
+}
+
+func newPlayer(records []record) *player {
+	metas := map[string]object.MetaObject{}
+	for _, r := range records {
+		if r.Kind != recordTrace || r.Method == "" {
+			continue
+		}
+		meta, ok := metas[r.Service]
+		if !ok {
+			meta = object.MetaObject{
+				Methods:    map[uint32]object.MetaMethod{},
+				Signals:    map[uint32]object.MetaSignal{},
+				Properties: map[uint32]object.MetaProperty{},
+			}
+			metas[r.Service] = meta
+		}
+		id := r.Trace.SlotID
+		switch parseMemberKind(r.Member) {
+		case memberSignal:
+			meta.Signals[id] = object.MetaSignal{Uid: id, Name: r.Method}
+		case memberProperty:
+			meta.Properties[id] = object.MetaProperty{Uid: id, Name: r.Method}
+		default:
+			meta.Methods[id] = object.MetaMethod{Uid: id, Name: r.Method}
+		}
+	}
+	return &player{
+		records:          records,
+		metas:            metas,
+		position:         records[0].Time,
+		speed:            1.0,
+		stats:            map[action]bus.MethodStatistics{},
+		payloadSizes:     map[action]float64{},
+		traceSubscribers: map[*replayQueue]string{},
+		logSubscribers:   map[*replayQueue]string{},
+	}
+}
+
+// run advances the replay position until the context expires.
+func (p *player) run(ctx context.Context) {
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.mutex.Lock()
+			if !p.paused {
+				elapsed := float64(now.Sub(last)) * p.speed
+				p.position = p.position.Add(time.Duration(elapsed))
+				p.emit()
+			}
+			p.mutex.Unlock()
+			last = now
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// emit applies the records up to the current position. The trace
+// events and the logs are queued: a blocking send would hold the mutex
+// and freeze the replay controls. Must be called with the mutex held.
+func (p *player) emit() {
+	for ; p.next < len(p.records); p.next++ {
+		r := p.records[p.next]
+		if r.Time.After(p.position) {
+			return
+		}
+		switch r.Kind {
+		case recordStats:
+			a := action{r.Service, r.Method, parseMemberKind(r.Member)}
+			if r.SizeAvg != 0 {
+				p.payloadSizes[a] = r.SizeAvg
+			}
+			p.stats[a] = bus.MethodStatistics{
+				Count: r.Count,
+				Wall: bus.MinMaxSum{
+					MinValue: float32(r.WallMin / 1000000.0),
+					MaxValue: float32(r.WallMax / 1000000.0),
+					CumulatedValue: float32(r.WallAvg *
+						float64(r.Count) / 1000000.0),
+				},
+				User: bus.MinMaxSum{
+					CumulatedValue: float32(r.UserAvg *
+						float64(r.Count) / 1000000.0),
+				},
+				System: bus.MinMaxSum{
+					CumulatedValue: float32(r.SysAvg *
+						float64(r.Count) / 1000000.0),
+				},
+			}
+		case recordTrace:
+			for q, service := range p.traceSubscribers {
+				if service == r.Service {
+					q.push(r)
+				}
+			}
+		case recordLog:
+			for q, service := range p.logSubscribers {
+				if service == r.Service {
+					q.push(r)
+				}
+			}
+		}
+	}
+}
+
+// seek moves the replay position by offset. It returns true when
+// the position moved backward: the subscriptions are then closed
+// since their data is no longer valid.
+func (p *player) seek(offset time.Duration) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	start := p.records[0].Time
+	end := p.records[len(p.records)-1].Time
+	position := p.position.Add(offset)
+	if position.Before(start) {
+		position = start
+	} else if position.After(end) {
+		position = end
+	}
+	rewind := position.Before(p.position)
+	if rewind {
+		p.next = 0
+		p.stats = map[action]bus.MethodStatistics{}
+		p.payloadSizes = map[action]float64{}
+		for q := range p.traceSubscribers {
+			q.stop()
+		}
+		for q := range p.logSubscribers {
+			q.stop()
+		}
+		p.traceSubscribers = map[*replayQueue]string{}
+		p.logSubscribers = map[*replayQueue]string{}
+	}
+	p.position = position
+	p.emit()
+	return rewind
+}
+
+func (p *player) togglePause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.paused = !p.paused
+}
+
+// setSpeed multiplies the replay speed by factor.
+func (p *player) setSpeed(factor float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	speed := p.speed * factor
+	if speed >= 1.0/64 && speed <= 64 {
+		p.speed = speed
+	}
+}
+
+// status describes the replay position.
+func (p *player) status() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	state := "playing"
+	if p.paused {
+		state = "paused"
+	}
+	return fmt.Sprintf("[replay %s x%g %s]",
+		p.position.Format("15:04:05"), p.speed, state)
+}
+
+// now returns the replay position.
+func (p *player) now() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.position
+}
+
+// statistics returns the method statistics at the replay position.
+func (p *player) statistics() (map[action]bus.MethodStatistics, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats := make(map[action]bus.MethodStatistics, len(p.stats))
+	for action, stat := range p.stats {
+		stats[action] = stat
+	}
+	return stats, nil
+}
+
+// sizes returns the average payload size of the signals and the
+// properties at the replay position.
+func (p *player) sizes() map[action]float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sizes := make(map[action]float64, len(p.payloadSizes))
+	for action, size := range p.payloadSizes {
+		sizes[action] = size
+	}
+	return sizes
+}
+
+func (p *player) trace(service string) (object.MetaObject, func(), chan bus.EventTrace, error) {
+	meta, ok := p.metas[service]
+	if !ok {
+		return meta, nil, nil, fmt.Errorf("no trace recorded for %s", service)
+	}
+	events := make(chan bus.EventTrace, replayBuffer)
+	q := newReplayQueue()
+	go func() {
+		defer close(events)
+		q.run(func(r record) bool {
+			e, err := r.Trace.event()
+			if err != nil {
+				return true
+			}
+			select {
+			case events <- e:
+				return true
+			case <-q.done:
+				return false
+			}
+		})
+	}()
+	p.mutex.Lock()
+	p.traceSubscribers[q] = service
+	p.mutex.Unlock()
+	return meta, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if _, ok := p.traceSubscribers[q]; ok {
+			delete(p.traceSubscribers, q)
+			q.stop()
+		}
+	}, events, nil
+}
+
+func (p *player) logs(service string) (func(), chan []qilog.LogMessage, error) {
+	logs := make(chan []qilog.LogMessage, replayBuffer)
+	q := newReplayQueue()
+	go func() {
+		defer close(logs)
+		q.run(func(r record) bool {
+			select {
+			case logs <- []qilog.LogMessage{r.Log.message()}:
+				return true
+			case <-q.done:
+				return false
+			}
+		})
+	}()
+	p.mutex.Lock()
+	p.logSubscribers[q] = service
+	p.mutex.Unlock()
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if _, ok := p.logSubscribers[q]; ok {
+			delete(p.logSubscribers, q)
+			q.stop()
+		}
+	}, logs, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/value"
+)
+
+func TestReplayQueue(t *testing.T) {
+	start := time.Unix(1000, 0)
+	count := 10 * replayBuffer
+	records := make([]record, count)
+	for i := range records {
+		e := bus.EventTrace{
+			Id:        uint32(i),
+			Kind:      int32(net.Call),
+			SlotId:    100,
+			Arguments: value.Int(int32(i)),
+		}
+		records[i] = record{
+			Kind:    recordTrace,
+			Time:    start.Add(time.Duration(i) * time.Millisecond),
+			Service: "A",
+			Method:  "m",
+			Trace:   newTraceRecord(e),
+		}
+	}
+	p := newPlayer(records)
+	_, cancel, events, err := p.trace("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	// a forward seek emits every event before the subscriber reads.
+	p.seek(time.Minute)
+	for i := 0; i < count; i++ {
+		select {
+		case e := <-events:
+			if e.Id != uint32(i) {
+				t.Fatalf("got event %d, want %d", e.Id, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d dropped", i)
+		}
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestLoadPlayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"stats", `{"time":"2020-01-01T00:00:00Z","service":"A","method":"m","count":1}`, ""},
+		{"invalid", `{"time":`, "test.json:1:"},
+		{"empty", ``, "empty recording"},
+		{"trace without trace", `{"kind":"trace","time":"2020-01-01T00:00:00Z","service":"A","method":"m"}`,
+			"test.json:1: trace record without trace"},
+		{"log without log", `{"kind":"log","time":"2020-01-01T00:00:00Z","service":"A"}`,
+			"test.json:1: log record without log"},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "test.json")
+		err := os.WriteFile(filename, []byte(test.content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadPlayer(filename)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -3,100 +3,500 @@ package selection
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mum4k/termdash/cell"
 	"github.com/mum4k/termdash/keyboard"
+	"github.com/mum4k/termdash/mouse"
 	"github.com/mum4k/termdash/private/canvas"
 	"github.com/mum4k/termdash/terminal/terminalapi"
 	"github.com/mum4k/termdash/widgetapi"
 	"github.com/mum4k/termdash/widgets/text"
-
-	tb "github.com/nsf/termbox-go"
 )
 
-// SelectionList displays a list of item which can be selected.
+// SelectionList displays a table whose rows can be selected.
+//
+// Each row represents an actionable item. The first line is the
+// header: it is never filtered out. Selecting a row passes its payload
+// to onSelect, selecting the header passes nil.
+//
+// The list does not subscribe to the keyboard events: its owner
+// forwards them to Keyboard. This lets the owner give precedence to
+// the search prompt over its own shortcuts.
+//
+// The list scrolls to keep the cursor visible. When the rows are
+// replaced, the cursor stays on the row with the same key. A frozen
+// list keeps the order of the rows: the new ones are added at the
+// end.
 //
-// Each line represents an actionable item.
+// A click moves the cursor, a double click selects the row and the
+// wheel moves the cursor.
 //
 // Implements widgetapi.Widget. This object is thread-safe.
 type SelectionList struct {
 	*text.Text
-	onSelect func(int, string) error
-	items    []string
-	current  int
-	first    int
+	mutex    sync.Mutex
+	onSelect func(interface{}) error
+	columns  []Column
+	rows     []Row
+	status   string
+	// order holds the indexes of the rows in display order.
+	order []int
+	// visible holds the indexes of the rows matching the filter,
+	// after the header.
+	visible []int
+	// current and first are indexes in visible.
+	current int
+	first   int
+	// height is the number of lines of the last drawn canvas.
+	height int
+
+	// searching is true while the search prompt is edited.
+	searching bool
+	query     string
+	filter    *regexp.Regexp
+	frozen    bool
+
+	// lastClick and lastClicked detect the double clicks.
+	lastClick   time.Time
+	lastClicked int
 }
 
+// doubleClick is the maximum delay between the clicks of a double
+// click.
+const doubleClick = 500 * time.Millisecond
+
+// wheelStep is the number of lines moved by a wheel event.
+const wheelStep = 3
+
+// header is the index of the header in visible.
+const header = -1
+
+// cursorColor is the background color of the line under the cursor:
+// the cells keep their own color.
+const cursorColor = cell.ColorBlue
+
 func New() (*SelectionList, error) {
 	t, err := text.New()
 	if err != nil {
 		return nil, err
 	}
 	return &SelectionList{
-		t,
-		func(int, string) error { return errors.New("not configured") },
-		[]string{},
-		0,
-		0,
+		Text:     t,
+		onSelect: func(interface{}) error { return errors.New("not configured") },
+		columns:  []Column{},
+		rows:     []Row{},
+		visible:  []int{header},
 	}, nil
 }
 
+// compileFilter returns a case insensitive regular expression
+// matching the query. Invalid regular expressions are matched as
+// plain text.
+func compileFilter(query string) *regexp.Regexp {
+	if query == "" {
+		return nil
+	}
+	filter, err := regexp.Compile("(?i)" + query)
+	if err != nil {
+		filter = regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+	}
+	return filter
+}
+
+// matches returns true if a searchable cell of the row matches the
+// filter. Must be called with the mutex held.
+func (s *SelectionList) matches(r Row) bool {
+	if s.filter == nil {
+		return true
+	}
+	for i, col := range s.columns {
+		if col.Searchable && s.filter.MatchString(r.cell(i).String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateVisible computes the rows matching the filter. Must be
+// called with the mutex held.
+func (s *SelectionList) updateVisible() {
+	s.visible = append(s.visible[:0], header)
+	for _, i := range s.order {
+		if s.matches(s.rows[i]) {
+			s.visible = append(s.visible, i)
+		}
+	}
+	if s.current >= len(s.visible) {
+		s.current = len(s.visible) - 1
+	}
+	if s.current < 0 {
+		s.current = 0
+	}
+	if s.first > s.current {
+		s.first = s.current
+	}
+}
+
+// writeHeader writes the labels of the columns and the status. Must
+// be called with the mutex held.
+func (s *SelectionList) writeHeader(opts ...cell.Option) {
+	labels := make([]string, len(s.columns))
+	for i, col := range s.columns {
+		labels[i] = pad(col.Label, col.Width, col.Align)
+	}
+	line := " " + strings.Join(labels, separator)
+	if s.status != "" {
+		line += "  " + s.status
+	}
+	s.Write(line+"\n", text.WriteCellOpts(opts...))
+}
+
+// writeRow writes the cells of a row. The cells are drawn with their
+// color and opts. Must be called with the mutex held.
+func (s *SelectionList) writeRow(r Row, opts ...cell.Option) {
+	s.Write(" ", text.WriteCellOpts(opts...))
+	for i, col := range s.columns {
+		if i > 0 {
+			s.Write(separator, text.WriteCellOpts(opts...))
+		}
+		c := r.cell(i)
+		cellOpts := opts
+		if c.Color != cell.ColorDefault {
+			cellOpts = append([]cell.Option{cell.FgColor(c.Color)}, opts...)
+		}
+		value := c.String()
+		padded := pad(value, col.Width, col.Align)
+		if col.Searchable {
+			s.writeMatches(padded, value, cellOpts...)
+		} else if padded != "" {
+			s.Write(padded, text.WriteCellOpts(cellOpts...))
+		}
+	}
+	s.Write("\n")
+}
+
+// writeMatches writes the text of a cell and highlights the value
+// matching the filter. Must be called with the mutex held.
+func (s *SelectionList) writeMatches(padded, value string, opts ...cell.Option) {
+	start := 0
+	offset := strings.Index(padded, value)
+	if s.filter != nil && offset >= 0 {
+		for _, match := range s.filter.FindAllStringIndex(value, -1) {
+			if match[0] == match[1] {
+				continue
+			}
+			begin, end := offset+match[0], offset+match[1]
+			if start < begin {
+				s.Write(padded[start:begin], text.WriteCellOpts(opts...))
+			}
+			matchOpts := append(append([]cell.Option{}, opts...),
+				cell.FgColor(cell.ColorCyan))
+			s.Write(padded[begin:end], text.WriteCellOpts(matchOpts...))
+			start = end
+		}
+	}
+	if start < len(padded) {
+		s.Write(padded[start:], text.WriteCellOpts(opts...))
+	}
+}
+
+// updateUI must be called with the mutex held.
 func (s *SelectionList) updateUI() {
 	s.Reset()
-	for i, item := range s.items[s.first:] {
-		l := fmt.Sprintf("%s\n", item)
+	if s.searching || s.filter != nil {
+		prompt := fmt.Sprintf("/%s", s.query)
+		if s.searching {
+			prompt += "_"
+		}
+		s.Write(prompt+"\n", text.WriteCellOpts(cell.FgColor(cell.ColorCyan)))
+	}
+	if s.first >= len(s.visible) {
+		return
+	}
+	for i, index := range s.visible[s.first:] {
+		var opts []cell.Option
 		if i+s.first == s.current {
-			opt := text.WriteCellOpts(cell.FgColor(cell.ColorYellow))
-			s.Write(l, opt)
+			opts = append(opts, cell.BgColor(cursorColor))
+		}
+		if index == header {
+			s.writeHeader(opts...)
 		} else {
-			s.Write(l)
+			s.writeRow(s.rows[index], opts...)
 		}
 	}
 }
 
+// Draw records the height of the canvas to scroll the list.
 func (s *SelectionList) Draw(cvs *canvas.Canvas, meta *widgetapi.Meta) error {
-	panic("Not yet implemented")
+	s.mutex.Lock()
+	if height := cvs.Area().Dy(); height != s.height {
+		s.height = height
+		s.scroll()
+		s.updateUI()
+	}
+	s.mutex.Unlock()
+	return s.Text.Draw(cvs, meta)
+}
+
+// prompt returns the number of lines used by the search prompt. Must
+// be called with the mutex held.
+func (s *SelectionList) prompt() int {
+	if s.searching || s.filter != nil {
+		return 1
+	}
+	return 0
+}
+
+// lines returns the number of rows displayed. Must be called with
+// the mutex held.
+func (s *SelectionList) lines() int {
+	rows := s.height - s.prompt()
+	if rows < 1 {
+		return 1
+	}
+	return rows
+}
+
+// scroll updates first to display the cursor. Must be called with the
+// mutex held.
+func (s *SelectionList) scroll() {
+	if s.current < s.first {
+		s.first = s.current
+	}
+	if s.height > 0 && s.current >= s.first+s.lines() {
+		s.first = s.current - s.lines() + 1
+	}
+	if s.first < 0 {
+		s.first = 0
+	}
+}
+
+// move moves the cursor by step lines and scrolls the list to keep
+// the cursor visible. Must be called with the mutex held.
+func (s *SelectionList) move(step int) {
+	s.current += step
+	if s.current >= len(s.visible) {
+		s.current = len(s.visible) - 1
+	}
+	if s.current < 0 {
+		s.current = 0
+	}
+	s.scroll()
+}
+
+// selected calls onSelect with the payload of the row under the
+// cursor. Must be called with the mutex held: it is released.
+func (s *SelectionList) selected() error {
+	if s.current >= len(s.visible) {
+		s.mutex.Unlock()
+		return nil
+	}
+	var payload interface{}
+	if index := s.visible[s.current]; index != header {
+		payload = s.rows[index].Payload
+	}
+	onSelect := s.onSelect
+	s.mutex.Unlock()
+	return onSelect(payload)
 }
 
 func (s *SelectionList) Mouse(m *terminalapi.Mouse, meta *widgetapi.EventMeta) error {
-	panic("Not yet implemented")
+	s.mutex.Lock()
+	switch m.Button {
+	case mouse.ButtonWheelUp:
+		s.move(-wheelStep)
+		s.updateUI()
+	case mouse.ButtonWheelDown:
+		s.move(wheelStep)
+		s.updateUI()
+	case mouse.ButtonLeft:
+		line := s.first + m.Position.Y - s.prompt()
+		if line < s.first || line >= len(s.visible) {
+			break
+		}
+		now := time.Now()
+		double := line == s.lastClicked && now.Sub(s.lastClick) < doubleClick
+		s.lastClick, s.lastClicked = now, line
+		s.current = line
+		s.updateUI()
+		if double {
+			s.lastClick = time.Time{}
+			return s.selected()
+		}
+	}
+	s.mutex.Unlock()
+	return nil
 }
 
-func (s *SelectionList) Configure(items []string, onSelect func(int, string) error) {
-	s.items = items
+// Configure replaces the content of the list. The cursor follows the
+// row it was on. onSelect receives the payload of the selected row, or
+// nil for the header.
+func (s *SelectionList) Configure(table Table, onSelect func(payload interface{}) error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	selected, ok := s.selectedKey()
+	previous := s.keys()
+	s.columns = table.Columns
+	s.rows = table.Rows
+	s.status = table.Status
 	s.onSelect = onSelect
+	s.arrange(previous)
+	s.updateVisible()
+	if ok {
+		for i, index := range s.visible {
+			if index != header && s.rows[index].Key == selected {
+				s.current = i
+				break
+			}
+		}
+	}
+	s.scroll()
+	s.updateUI()
+}
+
+// selectedKey returns the key of the row under the cursor. The
+// header is not tracked. Must be called with the mutex held.
+func (s *SelectionList) selectedKey() (string, bool) {
+	if s.current <= 0 || s.current >= len(s.visible) {
+		return "", false
+	}
+	return s.rows[s.visible[s.current]].Key, true
+}
+
+// keys returns the keys of the rows in display order. Must be called
+// with the mutex held.
+func (s *SelectionList) keys() []string {
+	keys := make([]string, 0, len(s.order))
+	for _, index := range s.order {
+		keys = append(keys, s.rows[index].Key)
+	}
+	return keys
+}
+
+// arrange computes the display order of the rows. A frozen list
+// keeps the previous order (given as keys): the new rows come last.
+// Must be called with the mutex held.
+func (s *SelectionList) arrange(previous []string) {
+	s.order = s.order[:0]
+	for i := range s.rows {
+		s.order = append(s.order, i)
+	}
+	if !s.frozen {
+		return
+	}
+	ranks := make(map[string]int, len(previous))
+	for i, key := range previous {
+		ranks[key] = i
+	}
+	rank := func(index int) int {
+		if r, ok := ranks[s.rows[index].Key]; ok {
+			return r
+		}
+		return len(previous)
+	}
+	sort.SliceStable(s.order, func(i, j int) bool {
+		return rank(s.order[i]) < rank(s.order[j])
+	})
+}
+
+// Freeze keeps the order of the rows when frozen is set: the rows
+// passed to Configure are displayed in the previous order.
+func (s *SelectionList) Freeze(frozen bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.frozen = frozen
+}
+
+// Searching returns true while the search prompt is edited.
+func (s *SelectionList) Searching() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.searching
+}
+
+// Filtered returns true when the rows are filtered.
+func (s *SelectionList) Filtered() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.filter != nil
+}
+
+// search handles the keyboard events while the prompt is edited.
+// Must be called with the mutex held.
+func (s *SelectionList) search(k *terminalapi.Keyboard) {
+	switch k.Key {
+	case keyboard.KeyEnter:
+		s.searching = false
+	case keyboard.KeyEsc:
+		s.searching = false
+		s.query = ""
+	case keyboard.KeyBackspace, keyboard.KeyBackspace2:
+		if len(s.query) > 0 {
+			runes := []rune(s.query)
+			s.query = string(runes[:len(runes)-1])
+		}
+	default:
+		if k.Key < 0x20 {
+			return
+		}
+		s.query += string(rune(k.Key))
+	}
+	s.filter = compileFilter(s.query)
+	s.current = 0
+	s.first = 0
+	s.updateVisible()
 	s.updateUI()
 }
 
 func (s *SelectionList) Keyboard(k *terminalapi.Keyboard, meta *widgetapi.EventMeta) error {
+	s.mutex.Lock()
+	if s.searching {
+		s.search(k)
+		s.mutex.Unlock()
+		return nil
+	}
 	switch k.Key {
+	case '/':
+		s.searching = true
+		s.updateUI()
+	case keyboard.KeyEsc:
+		s.query = ""
+		s.filter = nil
+		s.updateVisible()
+		s.updateUI()
 	case 'k', keyboard.KeyArrowUp:
-		if s.current > 0 {
-			s.current--
-			if s.first > 0 && s.current < s.first+2 {
-				s.first--
-			}
-		}
+		s.move(-1)
 		s.updateUI()
 	case 'j', keyboard.KeyArrowDown:
-		if s.current < len(s.items)-1 {
-			s.current++
-			_, heigh := tb.Size()
-			heigh = heigh/2 - 6
-			if s.first+heigh < s.current {
-				s.first++
-			}
-		}
+		s.move(1)
+		s.updateUI()
+	case keyboard.KeyPgUp:
+		s.move(-s.lines())
+		s.updateUI()
+	case keyboard.KeyPgDn:
+		s.move(s.lines())
+		s.updateUI()
+	case keyboard.KeyHome:
+		s.move(-len(s.visible))
+		s.updateUI()
+	case keyboard.KeyEnd:
+		s.move(len(s.visible))
 		s.updateUI()
 	case keyboard.KeyEnter:
-		index, item := s.current, s.items[s.current]
-		return s.onSelect(index, item)
+		return s.selected()
 	}
+	s.mutex.Unlock()
 	return nil
 }
 
 func (s *SelectionList) Options() widgetapi.Options {
 	opt := s.Text.Options()
-	opt.WantKeyboard = widgetapi.KeyScopeGlobal
+	opt.WantKeyboard = widgetapi.KeyScopeNone
+	opt.WantMouse = widgetapi.MouseScopeWidget
 	return opt
 }
@@ -0,0 +1,166 @@
+package selection
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mum4k/termdash/keyboard"
+	"github.com/mum4k/termdash/terminal/terminalapi"
+)
+
+// table returns a table of one searchable column whose keys and
+// payloads are the names.
+func table(names ...string) Table {
+	t := Table{
+		Columns: []Column{{Label: "name", Searchable: true}},
+		Rows:    make([]Row, len(names)),
+	}
+	for i, name := range names {
+		t.Rows[i] = Row{
+			Cells:   []Cell{{Value: name}},
+			Key:     name,
+			Payload: name,
+		}
+	}
+	return t
+}
+
+// displayed returns the keys of the visible rows.
+func displayed(s *SelectionList) []string {
+	keys := []string{}
+	for _, index := range s.visible {
+		if index != header {
+			keys = append(keys, s.rows[index].Key)
+		}
+	}
+	return keys
+}
+
+// cursor returns the key of the row under the cursor.
+func cursor(s *SelectionList) string {
+	key, _ := s.selectedKey()
+	return key
+}
+
+func newList(t *testing.T, height int) (*SelectionList, *interface{}) {
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.height = height
+	var selected interface{}
+	s.Configure(Table{}, func(payload interface{}) error {
+		selected = payload
+		return nil
+	})
+	return s, &selected
+}
+
+func (s *SelectionList) press(keys ...keyboard.Key) {
+	for _, key := range keys {
+		s.Keyboard(&terminalapi.Keyboard{Key: key}, nil)
+	}
+}
+
+func TestConfigureFollowsKey(t *testing.T) {
+	s, _ := newList(t, 10)
+	onSelect := s.onSelect
+	s.Configure(table("a", "b", "c"), onSelect)
+	s.press(keyboard.KeyArrowDown, keyboard.KeyArrowDown)
+	if got := cursor(s); got != "b" {
+		t.Fatalf("cursor: got %q, want b", got)
+	}
+	s.Configure(table("c", "a", "b"), onSelect)
+	if got := cursor(s); got != "b" {
+		t.Errorf("cursor after sort: got %q, want b", got)
+	}
+	s.Configure(table("c", "a"), onSelect)
+	if got := cursor(s); got == "b" {
+		t.Errorf("cursor on a removed row")
+	}
+}
+
+func TestArrange(t *testing.T) {
+	tests := []struct {
+		name   string
+		frozen bool
+		before []string
+		after  []string
+		want   []string
+	}{
+		{"not frozen", false, []string{"a", "b", "c"},
+			[]string{"c", "b", "a"}, []string{"c", "b", "a"}},
+		{"frozen", true, []string{"a", "b", "c"},
+			[]string{"c", "b", "a"}, []string{"a", "b", "c"}},
+		{"frozen with new rows", true, []string{"a", "b"},
+			[]string{"d", "b", "c", "a"}, []string{"a", "b", "d", "c"}},
+		{"frozen with removed rows", true, []string{"a", "b", "c"},
+			[]string{"c", "a"}, []string{"a", "c"}},
+	}
+	for _, test := range tests {
+		s, _ := newList(t, 10)
+		s.Configure(table(test.before...), s.onSelect)
+		s.Freeze(test.frozen)
+		s.Configure(table(test.after...), s.onSelect)
+		if got := displayed(s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectPayload(t *testing.T) {
+	s, selected := newList(t, 10)
+	s.Configure(table("a", "b"), s.onSelect)
+	s.press(keyboard.KeyArrowDown, keyboard.KeyArrowDown, keyboard.KeyEnter)
+	if *selected != "b" {
+		t.Errorf("selected: got %v, want b", *selected)
+	}
+	s.press(keyboard.KeyHome, keyboard.KeyEnter)
+	if *selected != nil {
+		t.Errorf("header selected: got %v, want nil", *selected)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	s, _ := newList(t, 10)
+	s.Configure(table("ALMotion.move", "ALMemory.getData", "ALMotion.stop"), s.onSelect)
+	s.press('/', 'm', 'o', 't', keyboard.KeyEnter)
+	want := []string{"ALMotion.move", "ALMotion.stop"}
+	if got := displayed(s); !reflect.DeepEqual(got, want) {
+		t.Errorf("filtered: got %v, want %v", got, want)
+	}
+	s.press(keyboard.KeyEsc)
+	if got := displayed(s); len(got) != 3 {
+		t.Errorf("filter cleared: got %v", got)
+	}
+}
+
+func TestScroll(t *testing.T) {
+	names := make([]string, 20)
+	for i := range names {
+		names[i] = string(rune('a' + i))
+	}
+	tests := []struct {
+		name    string
+		keys    []keyboard.Key
+		current int
+		first   int
+	}{
+		{"down", []keyboard.Key{keyboard.KeyArrowDown}, 1, 0},
+		{"page down", []keyboard.Key{keyboard.KeyPgDn}, 5, 1},
+		{"two pages down", []keyboard.Key{keyboard.KeyPgDn, keyboard.KeyPgDn}, 10, 6},
+		{"end", []keyboard.Key{keyboard.KeyEnd}, 20, 16},
+		{"end then page up", []keyboard.Key{keyboard.KeyEnd, keyboard.KeyPgUp}, 15, 15},
+		{"home", []keyboard.Key{keyboard.KeyEnd, keyboard.KeyHome}, 0, 0},
+		{"up at the top", []keyboard.Key{keyboard.KeyArrowUp}, 0, 0},
+	}
+	for _, test := range tests {
+		s, _ := newList(t, 5)
+		s.Configure(table(names...), s.onSelect)
+		s.press(test.keys...)
+		if s.current != test.current || s.first != test.first {
+			t.Errorf("%s: got current %d first %d, want %d %d", test.name,
+				s.current, s.first, test.current, test.first)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package selection
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mum4k/termdash/cell"
+)
+
+// Align is the alignment of the cells of a column.
+type Align int
+
+const (
+	AlignLeft Align = iota
+	AlignRight
+)
+
+// Column describes a column of the list.
+type Column struct {
+	Label string
+	// Width is the minimum number of characters of the cells.
+	Width int
+	Align Align
+	// Searchable is true for the columns matched by the filter.
+	Searchable bool
+}
+
+// Cell is a value of a row.
+type Cell struct {
+	// Value is displayed with Format. A nil value is displayed as
+	// "-".
+	Value interface{}
+	// Format is the fmt verb of the value ("%v" by default).
+	Format string
+	// Color is the color of the text. The line under the cursor is
+	// marked by its background.
+	Color cell.Color
+}
+
+// String returns the formatted value.
+func (c Cell) String() string {
+	if c.Value == nil {
+		return "-"
+	}
+	if c.Format == "" {
+		return fmt.Sprint(c.Value)
+	}
+	return fmt.Sprintf(c.Format, c.Value)
+}
+
+// Row is a line of the list.
+type Row struct {
+	// Cells holds one cell per column.
+	Cells []Cell
+	// Key identifies the row: the cursor follows the key when the
+	// rows are replaced.
+	Key string
+	// Payload is passed to onSelect when the row is selected.
+	Payload interface{}
+}
+
+// cell returns the cell of column i.
+func (r Row) cell(i int) Cell {
+	if i < len(r.Cells) {
+		return r.Cells[i]
+	}
+	return Cell{}
+}
+
+// Table is the content of the list.
+type Table struct {
+	// Columns describes the header.
+	Columns []Column
+	Rows    []Row
+	// Status is displayed after the header.
+	Status string
+}
+
+// separator is written between the cells.
+const separator = " | "
+
+// pad aligns s in width characters.
+func pad(s string, width int, align Align) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return s
+	}
+	if align == AlignRight {
+		return strings.Repeat(" ", width-n) + s
+	}
+	return s + strings.Repeat(" ", width-n)
+}
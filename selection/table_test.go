@@ -0,0 +1,55 @@
+package selection
+
+import "testing"
+
+func TestCellString(t *testing.T) {
+	tests := []struct {
+		name string
+		cell Cell
+		want string
+	}{
+		{"nil value", Cell{}, "-"},
+		{"nil value with format", Cell{Format: "%.1f"}, "-"},
+		{"default format", Cell{Value: 42}, "42"},
+		{"string", Cell{Value: "ALMotion.moveTo"}, "ALMotion.moveTo"},
+		{"float format", Cell{Value: 1.25, Format: "%.1f"}, "1.2"},
+		{"percent", Cell{Value: 12.5, Format: "%.1f%%"}, "12.5%"},
+		{"empty string", Cell{Value: ""}, ""},
+	}
+	for _, test := range tests {
+		if got := test.cell.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		align Align
+		want  string
+	}{
+		{"12", 5, AlignRight, "   12"},
+		{"12", 5, AlignLeft, "12   "},
+		{"123456", 5, AlignRight, "123456"},
+		{"µs", 4, AlignRight, "  µs"},
+		{"", 0, AlignLeft, ""},
+	}
+	for _, test := range tests {
+		if got := pad(test.s, test.width, test.align); got != test.want {
+			t.Errorf("pad(%q, %d): got %q, want %q",
+				test.s, test.width, got, test.want)
+		}
+	}
+}
+
+func TestRowCell(t *testing.T) {
+	r := Row{Cells: []Cell{{Value: 1}}}
+	if got := r.cell(0).String(); got != "1" {
+		t.Errorf("cell 0: got %q", got)
+	}
+	if got := r.cell(3).String(); got != "-" {
+		t.Errorf("missing cell: got %q, want -", got)
+	}
+}
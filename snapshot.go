@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// statsFile is the content of a file written by the snapshot key: the
+// statistics of every method since qitop started.
+type statsFile struct {
+	Time    time.Time `json:"time"`
+	Methods []record  `json:"methods"`
+}
+
+// saveSnapshot writes the statistics of the methods into a file
+// named after the time. An existing file is never overwritten: a
+// counter is added to the name. It returns the name of the file.
+func (h *highlight) saveSnapshot() (string, error) {
+	now := h.clock()
+	stats, err := h.statistics()
+	if err != nil {
+		return "", err
+	}
+	snapshot := statsFile{
+		Time:    now,
+		Methods: make([]record, 0, len(stats)),
+	}
+	for action, count := range stats {
+		if count.Count == 0 {
+			continue
+		}
+		snapshot.Methods = append(snapshot.Methods,
+			newRecord(now, entry{action: action, count: count}))
+	}
+	sort.Slice(snapshot.Methods, func(i, j int) bool {
+		a, b := snapshot.Methods[i], snapshot.Methods[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.Method < b.Method
+	})
+
+	base := fmt.Sprintf("qitop-%s", now.Format("20060102-150405"))
+	create := func(filename string) (*os.File, error) {
+		return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	filename := base + ".json"
+	file, err := create(filename)
+	for i := 2; os.IsExist(err); i++ {
+		filename = fmt.Sprintf("%s-%d.json", base, i)
+		file, err = create(filename)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return filename, encoder.Encode(snapshot)
+}
+
+func loadSnapshot(filename string) (statsFile, error) {
+	var snapshot statsFile
+	file, err := os.Open(filename)
+	if err != nil {
+		return snapshot, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&snapshot)
+	if err != nil {
+		return snapshot, fmt.Errorf("%s: %s", filename, err)
+	}
+	return snapshot, nil
+}
+
+// change is the difference of the statistics of a method between two
+// snapshots.
+type change struct {
+	name   string
+	before *record
+	after  *record
+}
+
+// latency returns the relative change of the average latency in
+// percent.
+func (c change) latency() float64 {
+	if c.before == nil || c.after == nil || c.before.WallAvg == 0 {
+		return 0
+	}
+	return (c.after.WallAvg - c.before.WallAvg) * 100 / c.before.WallAvg
+}
+
+// changes pairs the methods of two snapshots. The largest latency
+// increases come first.
+func changes(before, after statsFile) []change {
+	indexes := map[string]int{}
+	list := []change{}
+	get := func(r record) *change {
+		name := row{entry: entry{action: action{r.Service, r.Method,
+			parseMemberKind(r.Member)}}}.label()
+		i, ok := indexes[name]
+		if !ok {
+			i = len(list)
+			indexes[name] = i
+			list = append(list, change{name: name})
+		}
+		return &list[i]
+	}
+	for i := range before.Methods {
+		get(before.Methods[i]).before = &before.Methods[i]
+	}
+	for i := range after.Methods {
+		get(after.Methods[i]).after = &after.Methods[i]
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if a, b := list[i].latency(), list[j].latency(); a != b {
+			return a > b
+		}
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// writeChanges prints the changes as a table. The methods whose
+// latency increased by more than threshold percent are marked as
+// regressions, in red when color is set.
+func writeChanges(w io.Writer, list []change, threshold float64, color bool) {
+	columns := []string{"count a", "count b", "avg a (us)", "avg b (us)",
+		"change", "max a (us)", "max b (us)"}
+	widths := []int{9, 9, 11, 11, 8, 11, 11}
+	cells := make([]string, len(columns))
+	for i, label := range columns {
+		cells[i] = alignRight(label, widths[i])
+	}
+	fmt.Fprintf(w, "  %s | Service.Method\n", strings.Join(cells, " | "))
+	for _, c := range list {
+		for i := range cells {
+			cells[i] = alignRight("-", widths[i])
+		}
+		if c.before != nil {
+			cells[0] = alignRight(fmt.Sprintf("%d", c.before.Count), widths[0])
+			cells[2] = alignRight(fmt.Sprintf("%.0f", c.before.WallAvg), widths[2])
+			cells[5] = alignRight(fmt.Sprintf("%.0f", c.before.WallMax), widths[5])
+		}
+		if c.after != nil {
+			cells[1] = alignRight(fmt.Sprintf("%d", c.after.Count), widths[1])
+			cells[3] = alignRight(fmt.Sprintf("%.0f", c.after.WallAvg), widths[3])
+			cells[6] = alignRight(fmt.Sprintf("%.0f", c.after.WallMax), widths[6])
+		}
+		if c.before != nil && c.after != nil {
+			cells[4] = alignRight(fmt.Sprintf("%+.1f%%", c.latency()), widths[4])
+		}
+		line := fmt.Sprintf("%s | %s", strings.Join(cells, " | "), c.name)
+		switch {
+		case c.latency() <= threshold:
+			fmt.Fprintf(w, "  %s\n", line)
+		case color:
+			fmt.Fprintf(w, "\x1b[31m! %s\x1b[0m\n", line)
+		default:
+			fmt.Fprintf(w, "! %s\n", line)
+		}
+	}
+}
+
+// isTerminal returns true if the file is a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// runDiff implements the diff command: it compares two files written
+// by the snapshot key.
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	threshold := flags.Float64("threshold", 10,
+		"latency increase in percent reported as a regression")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: qitop diff [options] a.json b.json\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("diff expects two snapshots")
+	}
+	before, err := loadSnapshot(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := loadSnapshot(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("a: %s (%s)\nb: %s (%s)\n\n",
+		flags.Arg(0), before.Time.Format(time.RFC3339),
+		flags.Arg(1), after.Time.Format(time.RFC3339))
+	writeChanges(os.Stdout, changes(before, after), *threshold,
+		isTerminal(os.Stdout))
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lugu/qiloop/bus"
+	qilog "github.com/lugu/qiloop/bus/logger"
+	"github.com/lugu/qiloop/bus/services"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// source provides the trace events and the log messages of the
+// services: either from a live session or from a recording.
+type source interface {
+	// trace subscribes to the trace events of an object (see
+	// objectName). It returns the meta object describing the slots
+	// of the events.
+	trace(service string) (object.MetaObject, func(), chan bus.EventTrace, error)
+	// logs subscribes to the log messages of the process hosting
+	// an object.
+	logs(service string) (func(), chan []qilog.LogMessage, error)
+}
+
+// liveSource subscribes to the services of a session.
+type liveSource struct {
+	sess bus.Session
+}
+
+func (s liveSource) trace(service string) (object.MetaObject, func(), chan bus.EventTrace, error) {
+	obj, err := getObject(s.sess, service)
+	if err != nil {
+		return object.MetaObject{}, nil, nil, fmt.Errorf("trace %s: %s", service, err)
+	}
+
+	meta, err := obj.MetaObject(obj.Proxy().ObjectID())
+	if err != nil {
+		return meta, nil, nil, fmt.Errorf("%s: MetaObject: %s.", service, err)
+	}
+
+	err = obj.EnableTrace(true)
+	if err != nil {
+		return meta, nil, nil, fmt.Errorf("Failed to start traces: %s", err)
+	}
+
+	cancel, events, err := obj.SubscribeTraceObject()
+	if err != nil {
+		obj.EnableTrace(false)
+		return meta, nil, nil, fmt.Errorf("Failed to subscribe traces: %s.", err)
+	}
+	return meta, func() {
+		cancel()
+		obj.EnableTrace(false)
+	}, events, nil
+}
+
+func (s liveSource) logs(service string) (func(), chan []qilog.LogMessage, error) {
+	service, _ = splitObject(service)
+	directory, err := services.ServiceDirectory(s.sess)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := directory.Service(service)
+	if err != nil {
+		return nil, nil, fmt.Errorf("service not found (%s): %s", service, err)
+	}
+	location := fmt.Sprintf("%s:%d", info.MachineId, info.ProcessId)
+
+	logManager, err := qilog.LogManager(s.sess)
+	if err != nil {
+		return nil, nil, fmt.Errorf("access LogManager service: %s", err)
+	}
+	logListener, err := logManager.CreateListener()
+	if err != nil {
+		return nil, nil, fmt.Errorf("create listener: %s", err)
+	}
+
+	err = logListener.ClearFilters()
+	if err != nil {
+		return nil, nil, fmt.Errorf("clear filters: %s", err)
+	}
+	cancel, logs, err := logListener.SubscribeOnLogMessages()
+	if err != nil {
+		return nil, nil, fmt.Errorf("subscribe logs: %s", err)
+	}
+
+	err = logListener.SetLevel(logLevel)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("set verbosity: %s", err)
+	}
+
+	// only forward the messages of the process.
+	filtered := make(chan []qilog.LogMessage)
+	go func() {
+		defer close(filtered)
+		defer logListener.Terminate(logListener.Proxy().ObjectID())
+		for msgs := range logs {
+			selected := make([]qilog.LogMessage, 0, len(msgs))
+			for _, m := range msgs {
+				if m.Level == qilog.LogLevelNone {
+					continue
+				}
+				if m.Location != location {
+					continue
+				}
+				selected = append(selected, m)
+			}
+			if len(selected) != 0 {
+				filtered <- selected
+			}
+		}
+	}()
+	return cancel, filtered, nil
+}
@@ -5,36 +5,267 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/lugu/qiloop/bus"
 	sd "github.com/lugu/qiloop/bus/services"
+	"github.com/lugu/qitop/selection"
 	"github.com/mum4k/termdash/container"
+	"github.com/mum4k/termdash/terminal/terminalapi"
 )
 
+// action identifies a method, a signal or a property of a service.
+type action struct {
+	service string
+	method  string
+	kind    memberKind
+}
+
+func (a action) String() string {
+	if a.method == "" {
+		return a.service
+	}
+	return fmt.Sprintf("%s.%s", a.service, a.method)
+}
+
 type entry struct {
 	count  bus.MethodStatistics
-	action string
+	action action
+
+	// delta holds the calls made during the last window.
+	delta  bus.MethodStatistics
+	window time.Duration
+	// share is the percentage of the wall time of the window.
+	share float64
+	// size is the average payload size of the signals and the
+	// properties.
+	size float64
+}
+
+// rate returns the number of calls per second during the window.
+func (e entry) rate() float64 {
+	if e.window <= 0 {
+		return 0
+	}
+	return float64(e.delta.Count) / e.window.Seconds()
+}
+
+// latency returns the average wall time in seconds during the
+// window.
+func (e entry) latency() float64 {
+	if e.delta.Count == 0 {
+		return 0
+	}
+	return float64(e.delta.Wall.CumulatedValue) / float64(e.delta.Count)
+}
+
+// diffStats returns the statistics of the calls made between old
+// and stat. Minimum and maximum values are not windowed.
+func diffStats(stat, old bus.MethodStatistics) bus.MethodStatistics {
+	if stat.Count < old.Count {
+		// statistics have been cleared
+		return stat
+	}
+	diff := stat
+	diff.Count -= old.Count
+	diff.Wall.CumulatedValue -= old.Wall.CumulatedValue
+	diff.User.CumulatedValue -= old.User.CumulatedValue
+	diff.System.CumulatedValue -= old.System.CumulatedValue
+	return diff
+}
+
+// sortKey identifies the value used to sort the top list.
+type sortKey int
+
+const (
+	sortRate sortKey = iota
+	sortLatency
+	sortShare
+	sortCount
+	sortMin
+	sortMax
+	sortAvg
+	sortTotal
+	sortUserAvg
+	sortUserTotal
+	sortSystemAvg
+	sortSystemTotal
+	sortSize
+	sortName
+)
+
+// value returns the numerical value of a sort key.
+func (e entry) value(key sortKey) float64 {
+	switch key {
+	case sortRate:
+		return e.rate()
+	case sortLatency:
+		return e.latency()
+	case sortShare:
+		return e.share
+	case sortCount:
+		return float64(e.count.Count)
+	case sortMin:
+		return float64(e.count.Wall.MinValue)
+	case sortMax:
+		return float64(e.count.Wall.MaxValue)
+	case sortAvg:
+		return float64(e.count.Wall.CumulatedValue) / float64(e.count.Count)
+	case sortTotal:
+		return float64(e.count.Wall.CumulatedValue)
+	case sortUserAvg:
+		return float64(e.count.User.CumulatedValue) / float64(e.count.Count)
+	case sortUserTotal:
+		return float64(e.count.User.CumulatedValue)
+	case sortSystemAvg:
+		return float64(e.count.System.CumulatedValue) / float64(e.count.Count)
+	case sortSystemTotal:
+		return float64(e.count.System.CumulatedValue)
+	case sortSize:
+		return e.size
+	default:
+		return 0
+	}
+}
+
+// mostUsed is the default order: the most called methods during the
+// window first.
+func mostUsed(a, b entry) bool {
+	if a.delta.Count != b.delta.Count {
+		return a.delta.Count > b.delta.Count
+	}
+	if a.delta.Wall.CumulatedValue != b.delta.Wall.CumulatedValue {
+		return a.delta.Wall.CumulatedValue > b.delta.Wall.CumulatedValue
+	}
+	if a.count.Count == b.count.Count {
+		return a.count.Wall.CumulatedValue > b.count.Wall.CumulatedValue
+	}
+	return a.count.Count > b.count.Count
+}
+
+// sumStats returns the statistics of the calls of a and b.
+func sumStats(a, b bus.MethodStatistics) bus.MethodStatistics {
+	return bus.MethodStatistics{
+		Count:  a.Count + b.Count,
+		Wall:   sumMinMax(a.Wall, b.Wall),
+		User:   sumMinMax(a.User, b.User),
+		System: sumMinMax(a.System, b.System),
+	}
+}
+
+func sumMinMax(a, b bus.MinMaxSum) bus.MinMaxSum {
+	sum := bus.MinMaxSum{
+		MinValue:       a.MinValue,
+		MaxValue:       a.MaxValue,
+		CumulatedValue: a.CumulatedValue + b.CumulatedValue,
+	}
+	if b.MinValue < sum.MinValue {
+		sum.MinValue = b.MinValue
+	}
+	if b.MaxValue > sum.MaxValue {
+		sum.MaxValue = b.MaxValue
+	}
+	return sum
+}
+
+// gallery sorts the entries by decreasing value of a key (or by
+// name in alphabetical order).
+type gallery struct {
+	entries []entry
+	key     sortKey
+	reverse bool
+}
+
+func (g gallery) Len() int      { return len(g.entries) }
+func (g gallery) Swap(i, j int) { g.entries[i], g.entries[j] = g.entries[j], g.entries[i] }
+func (g gallery) Less(i, j int) bool {
+	if g.reverse {
+		i, j = j, i
+	}
+	a, b := g.entries[i], g.entries[j]
+	if g.key == sortName {
+		return a.action.String() < b.action.String()
+	}
+	if va, vb := a.value(g.key), b.value(g.key); va != vb {
+		return va > vb
+	}
+	return mostUsed(a, b)
+}
+
+// snapshot is the statistics of every method at a given time.
+type snapshot struct {
+	time  time.Time
+	stats map[action]bus.MethodStatistics
 }
 
-type gallery []entry
+// mainObject is the ID of the object registered with a service.
+const mainObject = 1
+
+// objectName returns the name of an object in the top list: the
+// objects other than the main one are suffixed with their ID.
+func objectName(service string, objectID uint32) string {
+	if objectID == mainObject {
+		return service
+	}
+	return fmt.Sprintf("%s/%d", service, objectID)
+}
+
+// splitObject returns the service and the object ID of a name
+// returned by objectName.
+func splitObject(name string) (string, uint32) {
+	i := strings.LastIndex(name, "/")
+	if i == -1 {
+		return name, mainObject
+	}
+	objectID, err := strconv.ParseUint(name[i+1:], 10, 32)
+	if err != nil {
+		return name, mainObject
+	}
+	return name[:i], uint32(objectID)
+}
+
+// parseObjects parses the -object flag: a comma separated list of
+// Service/ID. The main objects and the duplicates are ignored.
+func parseObjects(list string) (map[string][]uint32, error) {
+	objects := map[string][]uint32{}
+	if list == "" {
+		return objects, nil
+	}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		service, objectID := splitObject(name)
+		if service == name || objectID == 0 {
+			return nil, fmt.Errorf("invalid object: %s (expecting Service/ID)", name)
+		}
+		name = objectName(service, objectID)
+		if objectID == mainObject || seen[name] {
+			continue
+		}
+		seen[name] = true
+		objects[service] = append(objects[service], objectID)
+	}
+	return objects, nil
+}
 
-func (e gallery) Len() int      { return len(e) }
-func (e gallery) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
-func (e gallery) Less(i, j int) bool {
-	if e[i].count.Count == e[j].count.Count {
-		return e[i].count.Wall.CumulatedValue >
-			e[j].count.Wall.CumulatedValue
+// objectNames returns the names of the tracked objects of a service:
+// its main object followed by the ones of -object.
+func objectNames(service string) []string {
+	names := []string{service}
+	for _, objectID := range secondaryObjects[service] {
+		names = append(names, objectName(service, objectID))
 	}
-	return e[i].count.Count > e[j].count.Count
+	return names
 }
 
-func getObject(sess bus.Session, info sd.ServiceInfo) (bus.ObjectProxy, error) {
-	proxy, err := sess.Proxy(info.Name, 1)
+// getObject returns the object of a name returned by objectName.
+func getObject(sess bus.Session, name string) (bus.ObjectProxy, error) {
+	service, objectID := splitObject(name)
+	proxy, err := sess.Proxy(service, objectID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect service (%s): %s", info.Name, err)
+		return nil, fmt.Errorf("failed to connect service (%s): %s", name, err)
 	}
 	return bus.MakeObject(proxy), nil
 }
@@ -53,20 +284,76 @@ func periodic(ctx context.Context, interval time.Duration, fn func()) {
 
 type highlight struct {
 	services      map[string]bus.ObjectProxy
-	actions       map[string]string
+	actions       map[string]action
 	servicesMutex sync.Mutex
-}
+	// traffic counts the emissions of the signals and the
+	// properties when -signals is set.
+	traffic     map[action]traffic
+	unsubscribe map[string]func()
 
-func newHighlighter(ctx context.Context, cancel context.CancelFunc, c *container.Container, w *widgets) (*highlight, error) {
+	// statistics returns the statistics of every method. The count
+	// of the signals and the properties is their number of
+	// emissions.
+	statistics func() (map[action]bus.MethodStatistics, error)
+	// sizes returns the average payload size of the signals and
+	// the properties.
+	sizes func() map[action]float64
+	// clock returns the time of the statistics.
+	clock func() time.Time
+
+	// history holds the snapshots of the window, the oldest first.
+	history []snapshot
+	window  time.Duration
+
+	// refresh requests an update of the top list.
+	refresh   chan struct{}
+	viewMutex sync.Mutex
+	sortKey   sortKey
+	reverse   bool
+	view      viewType
+	// cpu shows the user and system time columns.
+	cpu bool
+	// expanded holds the services whose methods are listed.
+	expanded map[string]bool
+	// notice is displayed in the header until the next key.
+	notice string
+	// frozen keeps the order of the top list.
+	frozen bool
+}
 
+func newHighlight(window time.Duration) *highlight {
 	h := &highlight{
 		services: map[string]bus.ObjectProxy{},
-		actions:  map[string]string{},
+		actions:  map[string]action{},
+		clock:    time.Now,
+		history:  []snapshot{},
+		window:   window,
+		refresh:  make(chan struct{}, 1),
+		sortKey:  sortRate,
+		view:     viewMethods,
+		expanded: map[string]bool{},
+
+		traffic:     map[action]traffic{},
+		unsubscribe: map[string]func(){},
 	}
+	h.statistics = h.liveStatistics
+	h.sizes = h.liveSizes
+	return h
+}
 
-	err := h.initServices(ctx, sess, cancel)
-	if err != nil {
-		return nil, err
+func newHighlighter(ctx context.Context, cancel context.CancelFunc, c *container.Container, w *widgets) (*highlight, error) {
+
+	h := newHighlight(*window)
+
+	if p, ok := input.(*player); ok {
+		h.statistics = p.statistics
+		h.sizes = p.sizes
+		h.clock = p.now
+	} else {
+		err := h.initServices(ctx, sess, cancel)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	updater, err := h.updater(ctx, sess, cancel)
@@ -74,8 +361,9 @@ func newHighlighter(ctx context.Context, cancel context.CancelFunc, c *container
 		return nil, err
 	}
 
-	onSelect := func(index int, line string) error {
-		if index == 0 {
+	onSelect := func(payload interface{}) error {
+		r, ok := payload.(row)
+		if !ok {
 			setLayout(c, w, layoutTop)
 			if w.collector != nil {
 				w.collector.cancel()
@@ -87,24 +375,24 @@ func newHighlighter(ctx context.Context, cancel context.CancelFunc, c *container
 			}
 			return nil
 		}
-		setLayout(c, w, layoutTopTraceLogs)
 
-		labels := strings.SplitN(line, " | ", 5)
-		if len(labels) != 5 {
-			return fmt.Errorf("invalid line: %s", line)
-		}
-		desc := strings.SplitN(labels[4], ".", 2)
-		if len(desc) != 2 {
-			return fmt.Errorf("invalid service.action: %s", labels[4])
+		if r.service {
+			h.viewMutex.Lock()
+			h.expanded[r.action.service] = !r.expanded
+			h.viewMutex.Unlock()
+			h.update()
+			return nil
 		}
-		err := selectMethod(c, w, desc[0], desc[1])
+
+		setLayout(c, w, layoutTopTraceLogs)
+		err := selectMethod(c, w, r.action.service, r.action.method)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 
-	w.topList.Configure([]string{}, onSelect)
+	w.topList.Configure(selection.Table{}, onSelect)
 
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
@@ -112,22 +400,133 @@ func newHighlighter(ctx context.Context, cancel context.CancelFunc, c *container
 		for {
 			select {
 			case <-ticker.C:
-				lines, err := updater()
-				if err != nil {
-					mainErr = err
-					cancel()
-				}
-				w.topList.Configure(lines, onSelect)
+			case <-h.refresh:
 			case <-ctx.Done():
 				return
 			}
+			entries, err := updater()
+			if err != nil {
+				mainErr = err
+				cancel()
+			}
+			h.viewMutex.Lock()
+			rows := topRows(entries, h.view, h.expanded, h.sortKey, h.reverse)
+			table := topTable(rows, visibleColumns(h.cpu), h.sortKey, h.reverse)
+			status := []string{}
+			if p, ok := input.(*player); ok {
+				status = append(status, p.status())
+			}
+			if h.frozen {
+				status = append(status, "[frozen]")
+			}
+			if h.notice != "" {
+				status = append(status, h.notice)
+			}
+			table.Status = strings.Join(status, "  ")
+			w.topList.Freeze(h.frozen)
+			w.topList.Configure(table, onSelect)
+			h.viewMutex.Unlock()
 		}
 	}()
 	return h, nil
 }
 
-func (h *highlight) updateService(serviceName string, info sd.ServiceInfo) error {
-	obj, err := getObject(sess, info)
+// update requests an immediate refresh of the top list.
+func (h *highlight) update() {
+	select {
+	case h.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// keyboard handles the sort and the view controls of the top list.
+func (h *highlight) keyboard(k *terminalapi.Keyboard) {
+	notice := ""
+	if k.Key == 's' {
+		filename, err := h.saveSnapshot()
+		if err != nil {
+			notice = fmt.Sprintf("[snapshot failed: %s]", err)
+		} else {
+			notice = fmt.Sprintf("[snapshot saved: %s]", filename)
+		}
+	}
+	h.viewMutex.Lock()
+	defer h.viewMutex.Unlock()
+	if h.notice != "" || notice != "" {
+		h.notice = notice
+		h.update()
+	}
+	switch k.Key {
+	case 'F':
+		h.frozen = !h.frozen
+	case '<':
+		h.frozen = false
+		h.sortKey = nextSortKey(visibleColumns(h.cpu), h.sortKey, -1)
+	case '>':
+		h.frozen = false
+		h.sortKey = nextSortKey(visibleColumns(h.cpu), h.sortKey, 1)
+	case 'c':
+		h.cpu = !h.cpu
+		if !h.cpu && isCPUKey(h.sortKey) {
+			h.sortKey = sortRate
+		}
+	case 'r':
+		h.frozen = false
+		h.reverse = !h.reverse
+	case 'a':
+		if h.view == viewMethods {
+			h.view = viewServices
+		} else {
+			h.view = viewMethods
+		}
+	default:
+		return
+	}
+	h.update()
+}
+
+// updateService tracks the objects of a service. Only the failure of
+// the main object is returned: the secondary objects (such as a
+// listener) may disappear at any time.
+func (h *highlight) updateService(info sd.ServiceInfo) error {
+	names := objectNames(info.Name)
+	err := h.updateObject(names[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range names[1:] {
+		err := h.updateObject(name)
+		if err != nil {
+			log.Printf("failed to track %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// removeService stops tracking the objects of a service and forgets
+// the emissions of their members.
+func (h *highlight) removeService(service string) {
+	h.servicesMutex.Lock()
+	defer h.servicesMutex.Unlock()
+	removed := map[string]bool{}
+	for _, name := range objectNames(service) {
+		removed[name] = true
+		delete(h.services, name)
+		if cancel, ok := h.unsubscribe[name]; ok {
+			cancel()
+			delete(h.unsubscribe, name)
+		}
+	}
+	for a := range h.traffic {
+		if removed[a.service] {
+			delete(h.traffic, a)
+		}
+	}
+}
+
+// updateObject tracks an object named by objectName.
+func (h *highlight) updateObject(serviceName string) error {
+	obj, err := getObject(sess, serviceName)
 	if err != nil {
 		return err
 	}
@@ -144,16 +543,29 @@ func (h *highlight) updateService(serviceName string, info sd.ServiceInfo) error
 	if err != nil {
 		return err
 	}
+	var unsubscribe func()
+	if *signals {
+		unsubscribe = h.subscribeMembers(serviceName, obj, meta)
+	}
 	h.servicesMutex.Lock()
 	defer h.servicesMutex.Unlock()
 	h.services[serviceName] = obj
+	if cancel, ok := h.unsubscribe[serviceName]; ok {
+		cancel()
+		delete(h.unsubscribe, serviceName)
+	}
+	if unsubscribe != nil {
+		h.unsubscribe[serviceName] = unsubscribe
+	}
 	for id, method := range meta.Methods {
 		if ignoreAction(id) {
 			continue
 		}
 		actionID := fmt.Sprintf("%s.%d", serviceName, id)
-		actionName := fmt.Sprintf("%s.%s", serviceName, method.Name)
-		h.actions[actionID] = actionName
+		h.actions[actionID] = action{
+			service: serviceName,
+			method:  method.Name,
+		}
 	}
 	return nil
 }
@@ -176,7 +588,7 @@ func (h *highlight) initServices(ctx context.Context, sess bus.Session, cancel c
 	}
 
 	for _, info := range serviceList {
-		err = h.updateService(info.Name, info)
+		err = h.updateService(info)
 		if err != nil {
 			return err
 		}
@@ -204,17 +616,13 @@ func (h *highlight) initServices(ctx context.Context, sess bus.Session, cancel c
 					log.Print(err)
 					continue
 				}
-				err = h.updateService(srv.Name, info)
+				err = h.updateService(info)
 				if err != nil {
 					log.Print(err)
 					continue
 				}
 			case srv := <-removed:
-				h.servicesMutex.Lock()
-				if _, ok := h.services[srv.Name]; ok {
-					delete(h.services, srv.Name)
-				}
-				h.servicesMutex.Unlock()
+				h.removeService(srv.Name)
 			}
 		}
 	}()
@@ -222,59 +630,109 @@ func (h *highlight) initServices(ctx context.Context, sess bus.Session, cancel c
 	go func(ctx context.Context) {
 		<-ctx.Done()
 
+		h.servicesMutex.Lock()
+		defer h.servicesMutex.Unlock()
 		for _, obj := range h.services {
 			obj.EnableStats(false)
 		}
+		for _, cancel := range h.unsubscribe {
+			cancel()
+		}
 	}(ctx)
 	return nil
 }
 
-func (h *highlight) updater(ctx context.Context, sess bus.Session, cancel context.CancelFunc) (func() ([]string, error), error) {
-
-	return func() ([]string, error) {
-		for {
-			counter := map[string]bus.MethodStatistics{}
-			h.servicesMutex.Lock()
-			for name, obj := range h.services {
-				stats, err := obj.Stats()
-				if err != nil {
-					continue
-				}
-				for action, stat := range stats {
-					if ignoreAction(action) {
-						continue
-					}
-					entry := fmt.Sprintf("%s.%d", name, action)
-					action, ok := h.actions[entry]
-					if !ok {
-						continue
-					}
-					counter[action] = stat
-				}
+// liveStatistics queries the statistics of the tracked services.
+func (h *highlight) liveStatistics() (map[action]bus.MethodStatistics, error) {
+	counter := map[action]bus.MethodStatistics{}
+	h.servicesMutex.Lock()
+	defer h.servicesMutex.Unlock()
+	for name, obj := range h.services {
+		stats, err := obj.Stats()
+		if err != nil {
+			continue
+		}
+		for id, stat := range stats {
+			if ignoreAction(id) {
+				continue
 			}
-			h.servicesMutex.Unlock()
-			topC := make([]entry, 0)
-			for action, count := range counter {
-				if count.Count == 0 {
-					continue
-				}
-				topC = append(topC, entry{
-					action: action,
-					count:  count,
-				})
+			actionID := fmt.Sprintf("%s.%d", name, id)
+			action, ok := h.actions[actionID]
+			if !ok {
+				continue
 			}
-			sort.Sort(gallery(topC))
-			lines := make([]string, len(topC)+1)
-			lines[0] = " count | min (us) | max (us) | avg (us) | Service.Method"
-			for i, entry := range topC {
-				lines[i+1] = fmt.Sprintf(" %5d | %8.0f | %8.0f | %8.0f | %s",
-					entry.count.Count,
-					entry.count.Wall.MinValue*1000000.0,
-					entry.count.Wall.MaxValue*1000000.0,
-					entry.count.Wall.CumulatedValue*1000000.0/float32(entry.count.Count),
-					entry.action)
+			counter[action] = stat
+		}
+	}
+	for action, t := range h.traffic {
+		counter[action] = bus.MethodStatistics{Count: t.count}
+	}
+	return counter, nil
+}
+
+// liveSizes returns the average payload size of the signals and the
+// properties.
+func (h *highlight) liveSizes() map[action]float64 {
+	sizes := map[action]float64{}
+	h.servicesMutex.Lock()
+	defer h.servicesMutex.Unlock()
+	for action, t := range h.traffic {
+		sizes[action] = t.size()
+	}
+	return sizes
+}
+
+// updater returns a function which collects the statistics of all
+// the methods called at least once, sorted by usage during the
+// window.
+func (h *highlight) updater(ctx context.Context, sess bus.Session, cancel context.CancelFunc) (func() ([]entry, error), error) {
+
+	return func() ([]entry, error) {
+		now := h.clock()
+		counter, err := h.statistics()
+		if err != nil {
+			return nil, err
+		}
+		sizes := h.sizes()
+
+		// a replay rewind moves the clock backward: the snapshots
+		// are then later than the statistics.
+		if n := len(h.history); n > 0 && now.Before(h.history[n-1].time) {
+			h.history = h.history[:0]
+		}
+		// keep the most recent snapshot older than the window.
+		h.history = append(h.history, snapshot{now, counter})
+		for len(h.history) > 2 && now.Sub(h.history[1].time) >= h.window {
+			h.history = h.history[1:]
+		}
+		old := h.history[0]
+		elapsed := now.Sub(old.time)
+
+		topC := make([]entry, 0)
+		total := float32(0)
+		for action, count := range counter {
+			if count.Count == 0 {
+				continue
+			}
+			delta := diffStats(count, old.stats[action])
+			total += delta.Wall.CumulatedValue
+			topC = append(topC, entry{
+				action: action,
+				count:  count,
+				delta:  delta,
+				window: elapsed,
+				size:   sizes[action],
+			})
+		}
+		if total > 0 {
+			for i := range topC {
+				topC[i].share = float64(topC[i].delta.Wall.CumulatedValue) *
+					100.0 / float64(total)
 			}
-			return lines, nil
 		}
+		h.viewMutex.Lock()
+		sort.Sort(gallery{topC, h.sortKey, h.reverse})
+		h.viewMutex.Unlock()
+		return topC, nil
 	}, nil
 }
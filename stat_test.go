@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+)
+
+func TestDiffStats(t *testing.T) {
+	stats := func(count uint32, wall, user, system float32) bus.MethodStatistics {
+		return bus.MethodStatistics{
+			Count:  count,
+			Wall:   bus.MinMaxSum{MinValue: 0.1, MaxValue: 0.5, CumulatedValue: wall},
+			User:   bus.MinMaxSum{CumulatedValue: user},
+			System: bus.MinMaxSum{CumulatedValue: system},
+		}
+	}
+	tests := []struct {
+		name string
+		stat bus.MethodStatistics
+		old  bus.MethodStatistics
+		want bus.MethodStatistics
+	}{
+		{"no call", stats(3, 1, 0.5, 0.25), stats(3, 1, 0.5, 0.25),
+			stats(0, 0, 0, 0)},
+		{"new calls", stats(5, 3, 1, 0.5), stats(3, 1, 0.5, 0.25),
+			stats(2, 2, 0.5, 0.25)},
+		{"cleared", stats(1, 0.5, 0.25, 0.125), stats(3, 1, 0.5, 0.25),
+			stats(1, 0.5, 0.25, 0.125)},
+		{"first sample", stats(2, 1, 0.5, 0.25), bus.MethodStatistics{},
+			stats(2, 1, 0.5, 0.25)},
+	}
+	for _, test := range tests {
+		if got := diffStats(test.stat, test.old); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplitObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  string
+		objectID uint32
+	}{
+		{"ALMotion", "ALMotion", mainObject},
+		{"LogManager/2", "LogManager", 2},
+		{"LogManager/x", "LogManager/x", mainObject},
+		{"a/b/3", "a/b", 3},
+	}
+	for _, test := range tests {
+		service, objectID := splitObject(test.name)
+		if service != test.service || objectID != test.objectID {
+			t.Errorf("%s: got %s %d, want %s %d", test.name,
+				service, objectID, test.service, test.objectID)
+		}
+		if name := objectName(service, objectID); name != test.name {
+			t.Errorf("objectName: got %s, want %s", name, test.name)
+		}
+	}
+}
+
+func TestParseObjects(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    map[string][]uint32
+		invalid bool
+	}{
+		{"", map[string][]uint32{}, false},
+		{"LogManager/2", map[string][]uint32{"LogManager": {2}}, false},
+		{"LogManager/2,LogManager/3,Foo/4",
+			map[string][]uint32{"LogManager": {2, 3}, "Foo": {4}}, false},
+		{"LogManager/1,LogManager/2", map[string][]uint32{"LogManager": {2}}, false},
+		{"LogManager/2,LogManager/02", map[string][]uint32{"LogManager": {2}}, false},
+		{"LogManager", nil, true},
+		{"LogManager/0", nil, true},
+		{"LogManager/x", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseObjects(test.list)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expecting an error", test.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.list, got, test.want)
+		}
+	}
+}
+
+func TestUpdaterRewind(t *testing.T) {
+	h := newHighlight(10 * time.Second)
+	var now time.Time
+	var count uint32
+	h.clock = func() time.Time { return now }
+	h.statistics = func() (map[action]bus.MethodStatistics, error) {
+		return map[action]bus.MethodStatistics{
+			{"A", "m", memberMethod}: {Count: count},
+		}, nil
+	}
+	h.sizes = func() map[action]float64 { return nil }
+	update, err := h.updater(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		sec   int64
+		count uint32
+		rate  float64
+	}{
+		{"first", 100, 50, 0},
+		{"playing", 105, 60, 2},
+		{"rewind", 50, 5, 0},
+		{"after rewind", 51, 7, 2},
+	}
+	for _, test := range tests {
+		now, count = time.Unix(test.sec, 0), test.count
+		entries, err := update()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%s: got %d entries", test.name, len(entries))
+		}
+		if got := entries[0].rate(); got != test.rate {
+			t.Errorf("%s: got %g calls/s, want %g", test.name, got, test.rate)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mum4k/termdash/cell"
+)
+
+// threshold holds the latencies from which the latency cells of the
+// top list are displayed in yellow (warning) and in red (critical).
+// A zero latency disables the color.
+type threshold struct {
+	warning  time.Duration
+	critical time.Duration
+}
+
+// thresholdFile is an entry of the -thresholds file. The missing
+// latencies take the value of the flags.
+type thresholdFile struct {
+	Warning  string `json:"warning"`
+	Critical string `json:"critical"`
+}
+
+// loadThresholds reads the per-service thresholds of the -thresholds
+// file: a JSON object whose keys are the service names, for example
+// {"ALMotion": {"warning": "20ms", "critical": "200ms"}}.
+func loadThresholds(filename string) (map[string]threshold, error) {
+	thresholds := map[string]threshold{}
+	defaults := threshold{*latencyWarning, *latencyCritical}
+	if err := defaults.validate(); err != nil {
+		return nil, fmt.Errorf("-latency-warning, -latency-critical: %s", err)
+	}
+	if filename == "" {
+		return thresholds, nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := map[string]thresholdFile{}
+	err = json.NewDecoder(file).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	parse := func(service, value string, latency *time.Duration) error {
+		if value == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", filename, service, err)
+		}
+		*latency = d
+		return nil
+	}
+	for service, entry := range entries {
+		t := defaults
+		if err := parse(service, entry.Warning, &t.warning); err != nil {
+			return nil, err
+		}
+		if err := parse(service, entry.Critical, &t.critical); err != nil {
+			return nil, err
+		}
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", filename, service, err)
+		}
+		thresholds[service] = t
+	}
+	return thresholds, nil
+}
+
+// validate rejects the negative latencies and a warning latency above
+// the critical one: the yellow band would never show.
+func (t threshold) validate() error {
+	if t.warning < 0 || t.critical < 0 {
+		return fmt.Errorf("negative latency")
+	}
+	if t.warning > 0 && t.critical > 0 && t.warning > t.critical {
+		return fmt.Errorf("warning latency (%s) above the critical one (%s)",
+			t.warning, t.critical)
+	}
+	return nil
+}
+
+// serviceThreshold returns the threshold of a service. The secondary
+// objects share the one of their service.
+func serviceThreshold(service string) threshold {
+	if t, ok := thresholds[service]; ok {
+		return t
+	}
+	name, _ := splitObject(service)
+	if t, ok := thresholds[name]; ok {
+		return t
+	}
+	return threshold{*latencyWarning, *latencyCritical}
+}
+
+// color returns the color of a latency: green under the warning
+// latency, yellow under the critical one and red above. The default
+// color is used when both latencies are disabled.
+func (t threshold) color(latency time.Duration) cell.Color {
+	switch {
+	case t.critical > 0 && latency >= t.critical:
+		return cell.ColorRed
+	case t.warning > 0 && latency >= t.warning:
+		return cell.ColorYellow
+	case t.warning > 0 || t.critical > 0:
+		return cell.ColorGreen
+	default:
+		return cell.ColorDefault
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mum4k/termdash/cell"
+)
+
+// setLatencyFlags sets the -latency-warning and -latency-critical flags
+// for the duration of a test.
+func setLatencyFlags(t *testing.T, warning, critical time.Duration) {
+	w, c := *latencyWarning, *latencyCritical
+	*latencyWarning, *latencyCritical = warning, critical
+	t.Cleanup(func() {
+		*latencyWarning, *latencyCritical = w, c
+	})
+}
+
+func TestThresholdColor(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		threshold threshold
+		latency   time.Duration
+		want      cell.Color
+	}{
+		{"fast", threshold{10 * ms, 100 * ms}, 5 * ms, cell.ColorGreen},
+		{"warning", threshold{10 * ms, 100 * ms}, 10 * ms, cell.ColorYellow},
+		{"critical", threshold{10 * ms, 100 * ms}, 100 * ms, cell.ColorRed},
+		{"no warning", threshold{0, 100 * ms}, 50 * ms, cell.ColorGreen},
+		{"no critical", threshold{10 * ms, 0}, time.Second, cell.ColorYellow},
+		{"disabled", threshold{}, time.Second, cell.ColorDefault},
+	}
+	for _, test := range tests {
+		got := test.threshold.color(test.latency)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadThresholds(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]threshold
+		fails   bool
+	}{
+		{
+			name:    "both",
+			content: `{"A": {"warning": "20ms", "critical": "200ms"}}`,
+			want:    map[string]threshold{"A": {20 * ms, 200 * ms}},
+		},
+		{
+			name:    "defaults",
+			content: `{"A": {"warning": "20ms"}, "B": {"critical": "50ms"}}`,
+			want: map[string]threshold{
+				"A": {20 * ms, 100 * ms},
+				"B": {10 * ms, 50 * ms},
+			},
+		},
+		{
+			name:    "disabled",
+			content: `{"A": {"warning": "0s", "critical": "0s"}}`,
+			want:    map[string]threshold{"A": {}},
+		},
+		{
+			name:    "invalid duration",
+			content: `{"A": {"warning": "fast"}}`,
+			fails:   true,
+		},
+		{
+			name:    "negative",
+			content: `{"A": {"critical": "-1ms"}}`,
+			fails:   true,
+		},
+		{
+			name:    "warning above critical",
+			content: `{"A": {"warning": "300ms", "critical": "200ms"}}`,
+			fails:   true,
+		},
+		{
+			name:    "not an object",
+			content: `["A"]`,
+			fails:   true,
+		},
+	}
+	setLatencyFlags(t, 10*ms, 100*ms)
+	for _, test := range tests {
+		filename := filepath.Join(t.TempDir(), "thresholds.json")
+		err := os.WriteFile(filename, []byte(test.content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadThresholds(filename)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expecting an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		for service, want := range test.want {
+			if got[service] != want {
+				t.Errorf("%s: %s: got %v, want %v", test.name, service,
+					got[service], want)
+			}
+		}
+	}
+}
+
+func TestLoadThresholdsFlags(t *testing.T) {
+	setLatencyFlags(t, 10*time.Millisecond, 100*time.Millisecond)
+	got, err := loadThresholds("")
+	if err != nil || len(got) != 0 {
+		t.Errorf("no file: got %v, %v", got, err)
+	}
+	if _, err := loadThresholds(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("missing file: expecting an error")
+	}
+	setLatencyFlags(t, time.Second, 100*time.Millisecond)
+	if _, err := loadThresholds(""); err == nil {
+		t.Error("warning flag above critical: expecting an error")
+	}
+}
+
+func TestServiceThreshold(t *testing.T) {
+	ms := time.Millisecond
+	setLatencyFlags(t, 10*ms, 100*ms)
+	saved := thresholds
+	defer func() { thresholds = saved }()
+	thresholds = map[string]threshold{
+		"A":   {20 * ms, 200 * ms},
+		"A/2": {30 * ms, 300 * ms},
+	}
+	tests := []struct {
+		service string
+		want    threshold
+	}{
+		{"A", threshold{20 * ms, 200 * ms}},
+		{"A/2", threshold{30 * ms, 300 * ms}},
+		{"A/3", threshold{20 * ms, 200 * ms}},
+		{"B", threshold{10 * ms, 100 * ms}},
+	}
+	for _, test := range tests {
+		if got := serviceThreshold(test.service); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.service, got, test.want)
+		}
+	}
+}
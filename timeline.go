@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lugu/qiloop/app"
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	sd "github.com/lugu/qiloop/bus/services"
+	"github.com/lugu/qiloop/type/object"
+)
+
+// span is a call matched with its response.
+type span struct {
+	service string
+	method  string
+	pid     uint32
+	start   time.Time
+	end     time.Time
+	failed  bool
+}
+
+// chromeEvent is an event of the Chrome Trace Event format.
+type chromeEvent struct {
+	Name      string            `json:"name"`
+	Category  string            `json:"cat,omitempty"`
+	Phase     string            `json:"ph"`
+	Timestamp int64             `json:"ts"`
+	Duration  int64             `json:"dur,omitempty"`
+	Pid       uint32            `json:"pid"`
+	Tid       int               `json:"tid"`
+	Args      map[string]string `json:"args,omitempty"`
+}
+
+// chromeTrace is the JSON object format of the Chrome Trace Event
+// format, as read by Perfetto and chrome://tracing.
+type chromeTrace struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// laneWidth separates the thread IDs of the services of a process.
+const laneWidth = 1000
+
+// timeline collects the spans of the traced services.
+type timeline struct {
+	mutex sync.Mutex
+	spans []span
+}
+
+// add matches the trace events of a service and records the spans
+// until the channel is closed. The signal emissions are ignored.
+func (t *timeline) add(service string, pid uint32, meta object.MetaObject, events chan bus.EventTrace) {
+	pending := map[uint32]bus.EventTrace{}
+	for e := range events {
+		if e.Kind == traceSignal {
+			continue
+		}
+		call, response, ok := matchEvent(pending, e)
+		if !ok {
+			continue
+		}
+		evt := newCallEvent(call, response)
+		name, _, _ := member(meta, call.SlotId)
+		t.mutex.Lock()
+		t.spans = append(t.spans, span{
+			service: service,
+			method:  name,
+			pid:     pid,
+			start:   evt.timestamp,
+			end:     evt.timestamp.Add(evt.duration),
+			failed:  evt.responseType != net.Reply,
+		})
+		t.mutex.Unlock()
+	}
+}
+
+// events returns the spans as complete events. The overlapping calls
+// of a service are placed on separate lanes (one thread ID per lane)
+// since the events of a thread must be nested.
+func (t *timeline) events() []chromeEvent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	sort.SliceStable(t.spans, func(i, j int) bool {
+		return t.spans[i].start.Before(t.spans[j].start)
+	})
+
+	events := make([]chromeEvent, 0, len(t.spans))
+	services := map[string]int{}
+	// lanes holds the end of the last span of each lane.
+	lanes := map[string][]time.Time{}
+	processes := map[uint32]bool{}
+	for _, s := range t.spans {
+		index, ok := services[s.service]
+		if !ok {
+			index = len(services)
+			services[s.service] = index
+		}
+		if !processes[s.pid] {
+			processes[s.pid] = true
+			events = append(events, chromeEvent{
+				Name:  "process_name",
+				Phase: "M",
+				Pid:   s.pid,
+				Args:  map[string]string{"name": fmt.Sprintf("pid %d", s.pid)},
+			})
+		}
+		lane := 0
+		for ; lane < len(lanes[s.service]); lane++ {
+			if !lanes[s.service][lane].After(s.start) {
+				break
+			}
+		}
+		if lane == len(lanes[s.service]) {
+			lanes[s.service] = append(lanes[s.service], s.end)
+			events = append(events, chromeEvent{
+				Name:  "thread_name",
+				Phase: "M",
+				Pid:   s.pid,
+				Tid:   index*laneWidth + lane,
+				Args: map[string]string{
+					"name": fmt.Sprintf("%s #%d", s.service, lane),
+				},
+			})
+		} else {
+			lanes[s.service][lane] = s.end
+		}
+		category := "reply"
+		if s.failed {
+			category = "error"
+		}
+		events = append(events, chromeEvent{
+			Name:      fmt.Sprintf("%s.%s", s.service, s.method),
+			Category:  category,
+			Phase:     "X",
+			Timestamp: s.start.UnixNano() / 1000,
+			Duration:  s.end.Sub(s.start).Microseconds(),
+			Pid:       s.pid,
+			Tid:       index*laneWidth + lane,
+		})
+	}
+	return events
+}
+
+func (t *timeline) write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(chromeTrace{
+		TraceEvents:     t.events(),
+		DisplayTimeUnit: "ms",
+	})
+}
+
+// replayTimeline collects the spans of the trace events of a
+// recording or a capture. The process IDs are not recorded: each
+// service gets its own.
+func replayTimeline(p *player, services []string) (*timeline, error) {
+	t := &timeline{}
+	for i, service := range services {
+		meta, ok := p.metas[service]
+		if !ok {
+			return nil, fmt.Errorf("no trace recorded for %s", service)
+		}
+		events := make(chan bus.EventTrace)
+		done := make(chan struct{})
+		go func(pid uint32) {
+			t.add(service, pid, meta, events)
+			close(done)
+		}(uint32(i + 1))
+		for _, r := range p.records {
+			if r.Kind != recordTrace || r.Service != service {
+				continue
+			}
+			e, err := r.Trace.event()
+			if err != nil {
+				continue
+			}
+			events <- e
+		}
+		close(events)
+		<-done
+	}
+	return t, nil
+}
+
+// liveTimeline collects the spans of the services until the context
+// expires.
+func liveTimeline(ctx context.Context, services []string) (*timeline, error) {
+	directory, err := sd.ServiceDirectory(sess)
+	if err != nil {
+		return nil, err
+	}
+	src := liveSource{sess}
+	t := &timeline{}
+
+	// stop closes the subscriptions and waits for the last spans.
+	var wait sync.WaitGroup
+	cancels := []func(){}
+	stop := func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		wait.Wait()
+	}
+	for _, service := range services {
+		name, _ := splitObject(service)
+		info, err := directory.Service(name)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("service not found (%s): %s", name, err)
+		}
+		meta, cancel, events, err := src.trace(service)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		cancels = append(cancels, cancel)
+		wait.Add(1)
+		go func(service string, pid uint32) {
+			defer wait.Done()
+			t.add(service, pid, meta, events)
+		}(service, info.ProcessId)
+	}
+	<-ctx.Done()
+	stop()
+	return t, nil
+}
+
+// runTimeline implements the timeline command: it writes the calls of
+// some services in the Chrome Trace Event format, either traced live
+// or read from a recording (-replay) or a capture (-capture).
+func runTimeline(args []string) (err error) {
+
+	flags := flag.NewFlagSet("timeline", flag.ExitOnError)
+	output := flags.String("o", "-", "output file (- for stdout)")
+	duration := flags.Duration("duration", 0,
+		"tracing duration (0 traces until interrupted)")
+	traced := flags.String("trace", "",
+		"comma separated list of services whose calls are written")
+	flags.Parse(args)
+
+	if *traced == "" {
+		return fmt.Errorf("timeline: missing -trace")
+	}
+	services := strings.Split(*traced, ",")
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if *replayFile != "" || *captureFile != "" {
+		var p *player
+		if *replayFile != "" {
+			p, err = loadPlayer(*replayFile)
+		} else {
+			p, err = loadCapture(*captureFile)
+		}
+		if err != nil {
+			return err
+		}
+		t, err := replayTimeline(p, services)
+		if err != nil {
+			return err
+		}
+		return t.write(out)
+	}
+
+	sess, err = app.SessionFromFlag()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(*duration)
+	defer cancel()
+
+	t, err := liveTimeline(ctx, services)
+	if err != nil {
+		return err
+	}
+	return t.write(out)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/object"
+	"github.com/lugu/qiloop/type/value"
+)
+
+func TestTimelineLanes(t *testing.T) {
+	origin := time.Unix(1000, 0)
+	at := func(ms int) time.Time {
+		return origin.Add(time.Duration(ms) * time.Millisecond)
+	}
+	tl := &timeline{spans: []span{
+		{service: "A", method: "slow", pid: 1, start: at(0), end: at(100)},
+		// overlaps the slow call: second lane
+		{service: "A", method: "fast", pid: 1, start: at(10), end: at(20)},
+		// starts when the slow call ends: back to the first lane
+		{service: "A", method: "next", pid: 1, start: at(100), end: at(110)},
+		{service: "B", method: "other", pid: 2, start: at(5), end: at(50), failed: true},
+	}}
+	tids := map[string]int{}
+	threads, processes := 0, 0
+	for _, e := range tl.events() {
+		switch e.Name {
+		case "process_name":
+			processes++
+		case "thread_name":
+			threads++
+		default:
+			if e.Phase != "X" {
+				t.Errorf("%s: phase %s", e.Name, e.Phase)
+			}
+			tids[e.Name] = e.Tid
+		}
+	}
+	if processes != 2 || threads != 3 {
+		t.Errorf("got %d processes and %d threads, want 2 and 3",
+			processes, threads)
+	}
+	want := map[string]int{
+		"A.slow":  0,
+		"A.fast":  1,
+		"A.next":  0,
+		"B.other": laneWidth,
+	}
+	for name, tid := range want {
+		if got, ok := tids[name]; !ok || got != tid {
+			t.Errorf("%s: got tid %d, want %d", name, got, tid)
+		}
+	}
+}
+
+func TestTimelineWrite(t *testing.T) {
+	start := time.Unix(1, 500000000)
+	tl := &timeline{spans: []span{{service: "A", method: "m", pid: 7,
+		start: start, end: start.Add(3 * time.Millisecond), failed: true}}}
+	var buf bytes.Buffer
+	if err := tl.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var trace chromeTrace
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	last := trace.TraceEvents[len(trace.TraceEvents)-1]
+	if last.Timestamp != 1500000 || last.Duration != 3000 ||
+		last.Category != "error" || last.Pid != 7 {
+		t.Errorf("unexpected event: %+v", last)
+	}
+}
+
+func TestTimelineAdd(t *testing.T) {
+	meta := object.MetaObject{
+		Methods: map[uint32]object.MetaMethod{100: {Uid: 100, Name: "m"}},
+		Signals: map[uint32]object.MetaSignal{100: {Uid: 100, Name: "s"}},
+	}
+	events := make(chan bus.EventTrace, 3)
+	// the signal shares the ID of the call: it must not be paired.
+	event := func(kind int32, sec int64) bus.EventTrace {
+		return bus.EventTrace{Id: 1, Kind: kind, SlotId: 100,
+			Arguments: value.Int(0), Timestamp: bus.Timeval{Tv_sec: sec}}
+	}
+	events <- event(traceSignal, 0)
+	events <- event(int32(net.Call), 1)
+	events <- event(int32(net.Reply), 2)
+	close(events)
+	tl := &timeline{}
+	tl.add("A", 1, meta, events)
+	if len(tl.spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(tl.spans))
+	}
+	s := tl.spans[0]
+	if s.method != "m" || s.end.Sub(s.start) != time.Second || s.failed {
+		t.Errorf("unexpected span: %+v", s)
+	}
+}
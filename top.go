@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lugu/qitop/selection"
+)
+
+// viewType represents the possible contents of the top list.
+type viewType int
+
+const (
+	// viewMethods: one line per method
+	viewMethods viewType = iota
+	// viewServices: one line per service, expandable into its
+	// methods
+	viewServices
+)
+
+// row is a line of the top list.
+type row struct {
+	entry
+	// service is true when the row aggregates the methods of a
+	// service.
+	service  bool
+	expanded bool
+	// nested is true for the methods listed under their service.
+	nested bool
+}
+
+// label returns the content of the Service.Method column. The
+// signals and the properties are marked with their kind.
+func (r row) label() string {
+	name := r.action.String()
+	if r.action.kind != memberMethod {
+		name += fmt.Sprintf(" (%s)", r.action.kind)
+	}
+	switch {
+	case r.service && r.expanded:
+		return "- " + r.action.service
+	case r.service:
+		return "+ " + r.action.service
+	case r.nested:
+		return "    " + name
+	default:
+		return name
+	}
+}
+
+// key identifies the row in the top list: it does not change when a
+// service is expanded.
+func (r row) key() string {
+	if r.service {
+		return r.action.service
+	}
+	return fmt.Sprintf("%s (%s)", r.action, r.action.kind)
+}
+
+// aggregate sums the statistics of the methods of each service. The
+// signals and the properties are not counted.
+func aggregate(entries []entry) []entry {
+	services := map[string]*entry{}
+	for _, e := range entries {
+		if e.action.kind != memberMethod {
+			continue
+		}
+		s, ok := services[e.action.service]
+		if !ok {
+			services[e.action.service] = &entry{
+				action: action{service: e.action.service},
+				count:  e.count,
+				delta:  e.delta,
+				window: e.window,
+				share:  e.share,
+			}
+			continue
+		}
+		s.count = sumStats(s.count, e.count)
+		s.delta = sumStats(s.delta, e.delta)
+		s.share += e.share
+	}
+	aggregated := make([]entry, 0, len(services))
+	for _, s := range services {
+		aggregated = append(aggregated, *s)
+	}
+	return aggregated
+}
+
+// topRows returns the rows of the view. The entries are sorted.
+func topRows(entries []entry, view viewType, expanded map[string]bool, key sortKey, reverse bool) []row {
+	rows := make([]row, 0, len(entries))
+	if view == viewMethods {
+		for _, e := range entries {
+			rows = append(rows, row{entry: e})
+		}
+		return rows
+	}
+	services := aggregate(entries)
+	sort.Sort(gallery{services, key, reverse})
+	for _, s := range services {
+		name := s.action.service
+		rows = append(rows, row{
+			entry:    s,
+			service:  true,
+			expanded: expanded[name],
+		})
+		if !expanded[name] {
+			continue
+		}
+		for _, e := range entries {
+			if e.action.service == name {
+				rows = append(rows, row{entry: e, nested: true})
+			}
+		}
+	}
+	return rows
+}
+
+// column describes a column of the top list.
+type column struct {
+	label string
+	width int
+	key   sortKey
+	// verb formats the value.
+	verb  string
+	value func(r row) interface{}
+	// cpu is true for the user and system time columns which are
+	// optional.
+	cpu bool
+	// traffic is true for the columns which apply to the signals
+	// and the properties.
+	traffic bool
+}
+
+var topColumns = []column{
+	{"calls/s", 8, sortRate, "%.1f", func(r row) interface{} {
+		return r.rate()
+	}, false, true},
+	{"last avg", 9, sortLatency, "%.0f", func(r row) interface{} {
+		return r.latency() * 1000000.0
+	}, false, false},
+	{"% time", 7, sortShare, "%.1f%%", func(r row) interface{} {
+		return r.share
+	}, false, false},
+	{"count", 6, sortCount, "%d", func(r row) interface{} {
+		return r.count.Count
+	}, false, true},
+	{"min (us)", 9, sortMin, "%.0f", func(r row) interface{} {
+		return r.count.Wall.MinValue * 1000000.0
+	}, false, false},
+	{"max (us)", 9, sortMax, "%.0f", func(r row) interface{} {
+		return r.count.Wall.MaxValue * 1000000.0
+	}, false, false},
+	{"avg (us)", 9, sortAvg, "%.0f", func(r row) interface{} {
+		return r.value(sortAvg) * 1000000.0
+	}, false, false},
+	{"total (ms)", 11, sortTotal, "%.1f", func(r row) interface{} {
+		return r.count.Wall.CumulatedValue * 1000.0
+	}, false, false},
+	{"user avg", 9, sortUserAvg, "%.0f", func(r row) interface{} {
+		return r.value(sortUserAvg) * 1000000.0
+	}, true, false},
+	{"user (ms)", 10, sortUserTotal, "%.1f", func(r row) interface{} {
+		return r.count.User.CumulatedValue * 1000.0
+	}, true, false},
+	{"sys avg", 9, sortSystemAvg, "%.0f", func(r row) interface{} {
+		return r.value(sortSystemAvg) * 1000000.0
+	}, true, false},
+	{"sys (ms)", 10, sortSystemTotal, "%.1f", func(r row) interface{} {
+		return r.count.System.CumulatedValue * 1000.0
+	}, true, false},
+	{"size (B)", 9, sortSize, "%.0f", func(r row) interface{} {
+		return r.size
+	}, false, true},
+	{"Service.Method", 0, sortName, "%s", func(r row) interface{} {
+		return r.label()
+	}, false, true},
+}
+
+// visibleColumns returns the columns to display.
+func visibleColumns(cpu bool) []column {
+	columns := make([]column, 0, len(topColumns))
+	for _, col := range topColumns {
+		if col.cpu && !cpu {
+			continue
+		}
+		if col.key == sortSize && !*signals {
+			continue
+		}
+		columns = append(columns, col)
+	}
+	return columns
+}
+
+// isCPUKey returns true if the key is the one of a CPU column.
+func isCPUKey(key sortKey) bool {
+	for _, col := range topColumns {
+		if col.key == key {
+			return col.cpu
+		}
+	}
+	return false
+}
+
+// isLatencyKey returns true if the key is the one of a column colored
+// by the latency thresholds.
+func isLatencyKey(key sortKey) bool {
+	switch key {
+	case sortLatency, sortAvg, sortMax:
+		return true
+	}
+	return false
+}
+
+// nextSortKey returns the key of the column next to the one of key
+// in the direction of step.
+func nextSortKey(columns []column, key sortKey, step int) sortKey {
+	for i, col := range columns {
+		if col.key == key {
+			i = (i + step + len(columns)) % len(columns)
+			return columns[i].key
+		}
+	}
+	return columns[0].key
+}
+
+// alignRight pads s with spaces to fill width characters.
+func alignRight(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return s
+	}
+	return strings.Repeat(" ", width-n) + s
+}
+
+// topTable formats the rows for the top list. The sort column is
+// marked with an arrow in the header.
+func topTable(rows []row, columns []column, key sortKey, reverse bool) selection.Table {
+	table := selection.Table{
+		Columns: make([]selection.Column, len(columns)),
+		Rows:    make([]selection.Row, len(rows)),
+	}
+	for i, col := range columns {
+		label := col.label
+		if col.key == key {
+			// names are in alphabetical order
+			if (key == sortName) == reverse {
+				label += "↓"
+			} else {
+				label += "↑"
+			}
+		}
+		table.Columns[i] = selection.Column{
+			Label: label,
+			Width: col.width,
+			Align: selection.AlignRight,
+		}
+		if col.key == sortName {
+			table.Columns[i].Align = selection.AlignLeft
+			table.Columns[i].Searchable = true
+		}
+	}
+	for i, r := range rows {
+		cells := make([]selection.Cell, len(columns))
+		for j, col := range columns {
+			if r.action.kind != memberMethod && !col.traffic ||
+				r.action.kind == memberMethod && col.key == sortSize {
+				continue
+			}
+			cells[j] = selection.Cell{
+				Value:  col.value(r),
+				Format: col.verb,
+			}
+			if latency := r.value(col.key); isLatencyKey(col.key) && latency > 0 {
+				cells[j].Color = serviceThreshold(r.action.service).color(
+					time.Duration(latency * float64(time.Second)))
+			}
+		}
+		table.Rows[i] = selection.Row{
+			Cells:   cells,
+			Key:     r.key(),
+			Payload: r,
+		}
+	}
+	return table
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"math"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/lugu/qiloop/bus"
@@ -39,10 +41,40 @@ func newCallEvent(call, response bus.EventTrace) callEvent {
 	}
 }
 
-type collector struct {
-	service string
-	method  string
-	slot    uint32
+// maxRateSeconds is the number of seconds of call rate kept.
+const maxRateSeconds = 3600
+
+// maxPoints is the number of values kept for the line charts: more
+// than the width of any terminal.
+const maxPoints = 2000
+
+// appendPoint appends a value to the data of a line chart and drops the
+// oldest values beyond maxPoints, whether the chart is drawn or not.
+func appendPoint(data []float64, value float64) []float64 {
+	data = append(data, value)
+	if len(data) > 2*maxPoints {
+		data = append(data[:0:0], data[len(data)-maxPoints:]...)
+	}
+	return data
+}
+
+// stackColors are the colors of the methods when the charts are
+// stacked.
+var stackColors = []cell.Color{
+	cell.ColorYellow,
+	cell.ColorGreen,
+	cell.ColorCyan,
+	cell.ColorMagenta,
+	cell.ColorRed,
+	cell.ColorBlue,
+	cell.ColorWhite,
+}
+
+// series holds the data of a traced method, signal or property.
+type series struct {
+	slot   uint32
+	method string
+	kind   memberKind
 
 	callData         []float64
 	replyData        []float64
@@ -50,69 +82,160 @@ type collector struct {
 	latencyErrorData []float64
 	sysTimeData      []float64
 	usrTimeData      []float64
+	durations        []time.Duration
+	// callRate and errorRate count the replies and the errors per
+	// second since origin.
+	origin    int64
+	callRate  []float64
+	errorRate []float64
+	apdex     apdex
+	slo       *slo
+	// emissions and bytes count the signal emissions.
+	emissions int
+	bytes     int
+
+	// latest is the second of the most recent event and received
+	// the local time of the last event: the idle seconds are
+	// counted from them since the clock of the traced process may
+	// differ.
+	latest   int64
+	received time.Time
+}
+
+func newSeries(slot uint32, method string, kind memberKind) *series {
+	s := &series{
+		slot:   slot,
+		method: method,
+		kind:   kind,
+
+		callData:         []float64{},
+		replyData:        []float64{},
+		latencyData:      []float64{},
+		latencyErrorData: []float64{},
+		sysTimeData:      []float64{},
+		usrTimeData:      []float64{},
+		durations:        []time.Duration{},
+		callRate:         []float64{},
+		errorRate:        []float64{},
+		apdex: apdex{
+			target: *apdexT,
+		},
+	}
+	if *sloLatency > 0 {
+		s.slo = &slo{
+			latency:   *sloLatency,
+			objective: *sloTarget / 100,
+		}
+	}
+	return s
+}
+
+// collector gathers the traces of every method of a service, along
+// with the emissions of its signals and properties. The charts
+// display one member (the slot) or all of them when stacked.
+type collector struct {
+	service string
+	method  string
+	slot    uint32
+	stacked bool
+
+	meta   object.MetaObject
+	series map[uint32]*series
+	mutex  sync.Mutex
 
 	cancel func()
 
-	pending map[uint32]bus.EventTrace
+	// pending holds the events waiting for their pair, arrivals
+	// their reception time.
+	pending  map[uint32]bus.EventTrace
+	arrivals map[uint32]time.Time
+	evicted  int
+	now      func() time.Time
+	debug    *debugView
+	payloads *payloadView
 }
 
+// methodID returns the slot of a method, a signal or a property.
 func methodID(meta object.MetaObject, method string) (uint32, error) {
 	for id, m := range meta.Methods {
 		if m.Name == method {
 			return id, nil
 		}
 	}
-	return 0, fmt.Errorf("method not found: %s", method)
-}
-
-func newCollector(sess bus.Session, w *widgets, service, method string) (*collector, error) {
-	objectID := uint32(1)
-	proxy, err := sess.Proxy(service, objectID)
-	if err != nil {
-		return nil, fmt.Errorf("trace %s: %s", service, err)
-	}
-	obj := bus.MakeObject(proxy)
-
-	meta, err := obj.MetaObject(objectID)
-	if err != nil {
-		return nil, fmt.Errorf("%s: MetaObject: %s.", service, err)
-	}
-
-	slot, err := methodID(meta, method)
-	if err != nil {
-		return nil, fmt.Errorf("method not found: %s.", method)
+	for id, s := range meta.Signals {
+		if s.Name == method {
+			return id, nil
+		}
 	}
-
-	obj.EnableTrace(true)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to start traces: %s", err)
+	for id, p := range meta.Properties {
+		if p.Name == method {
+			return id, nil
+		}
 	}
+	return 0, fmt.Errorf("method not found: %s", method)
+}
 
-	cancel, events, err := obj.SubscribeTraceObject()
+// newCollector traces all the methods of a service. The charts
+// display the method unless it is empty: the first method called is
+// displayed.
+func newCollector(w *widgets, service, method string) (*collector, error) {
+	meta, cancel, events, err := input.trace(service)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to stop stats: %s.", err)
+		return nil, err
 	}
 
 	c := &collector{
 		service: service,
 		method:  method,
-		slot:    slot,
 
-		cancel: cancel,
+		meta:   meta,
+		series: map[uint32]*series{},
+
+		pending:  map[uint32]bus.EventTrace{},
+		arrivals: map[uint32]time.Time{},
+		now:      time.Now,
+		debug:    w.debug,
+		payloads: w.payloads,
+	}
 
-		pending: map[uint32]bus.EventTrace{},
+	if p, ok := input.(*player); ok {
+		c.now = p.now
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	c.cancel = func() {
+		once.Do(func() {
+			cancel()
+			close(done)
+		})
+	}
 
-		callData:         []float64{},
-		replyData:        []float64{},
-		latencyData:      []float64{},
-		latencyErrorData: []float64{},
-		sysTimeData:      []float64{},
-		usrTimeData:      []float64{},
+	if method != "" {
+		c.slot, err = methodID(meta, method)
+		if err != nil {
+			c.cancel()
+			return nil, fmt.Errorf("method not found: %s.", method)
+		}
+		_, kind, _ := member(meta, c.slot)
+		c.series[c.slot] = newSeries(c.slot, method, kind)
 	}
 
+	// the age of the in-flight calls changes without events.
+	go func() {
+		ticker := time.NewTicker(pendingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.updateUI(w)
+			case <-done:
+				return
+			}
+		}
+	}()
+
 	// TODO: return a runner to a to the group.Run
 	go func(events chan bus.EventTrace) {
-		defer obj.EnableTrace(false)
 	start:
 		e, ok := <-events
 		if !ok {
@@ -136,41 +259,221 @@ func newCollector(sess bus.Session, w *widgets, service, method string) (*collec
 	return c, nil
 }
 
-func (c *collector) updateData(evt callEvent) {
+// methodName returns the name of a slot.
+func (c *collector) methodName(slot uint32) string {
+	name, _, _ := member(c.meta, slot)
+	return name
+}
+
+// metaMethod returns the description of a slot.
+func (c *collector) metaMethod(slot uint32) object.MetaMethod {
+	if m, ok := c.meta.Methods[slot]; ok {
+		return m
+	}
+	return object.MetaMethod{
+		Uid:  slot,
+		Name: c.methodName(slot),
+	}
+}
+
+// getSeries returns the series of a slot. The first series created
+// is displayed if no method is selected. Must be called with the
+// mutex held.
+func (c *collector) getSeries(slot uint32) *series {
+	s, ok := c.series[slot]
+	if !ok {
+		name, kind, _ := member(c.meta, slot)
+		s = newSeries(slot, name, kind)
+		c.series[slot] = s
+		if c.method == "" {
+			c.slot, c.method = slot, s.method
+		}
+	}
+	return s
+}
+
+// sortedSeries returns the series ordered by method name. Must be
+// called with the mutex held.
+func (c *collector) sortedSeries() []*series {
+	sorted := make([]*series, 0, len(c.series))
+	for _, s := range c.series {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].method < sorted[j].method
+	})
+	return sorted
+}
+
+// selected returns the service and the displayed method.
+func (c *collector) selected() (string, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.service, c.method
+}
+
+// cycle displays the next method in the direction of step.
+func (c *collector) cycle(step int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sorted := c.sortedSeries()
+	for i, s := range sorted {
+		if s.slot == c.slot {
+			i = (i + step + len(sorted)) % len(sorted)
+			c.slot, c.method = sorted[i].slot, sorted[i].method
+			return
+		}
+	}
+}
+
+// toggleStack switches between the display of one method and of all
+// the methods.
+func (c *collector) toggleStack() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stacked = !c.stacked
+}
+
+func (s *series) updateData(evt callEvent) {
 
 	if evt.responseType == net.Reply {
-		c.latencyData = append(c.latencyData, float64(evt.duration.Microseconds()))
-		c.latencyErrorData = append(c.latencyErrorData, math.NaN())
+		s.latencyData = appendPoint(s.latencyData, float64(evt.duration.Microseconds()))
+		s.latencyErrorData = appendPoint(s.latencyErrorData, math.NaN())
 	} else {
-		c.latencyData = append(c.latencyData, math.NaN())
-		c.latencyErrorData = append(c.latencyErrorData, float64(evt.duration.Microseconds()))
+		s.latencyData = appendPoint(s.latencyData, math.NaN())
+		s.latencyErrorData = appendPoint(s.latencyErrorData, float64(evt.duration.Microseconds()))
+	}
+	s.sysTimeData = appendPoint(s.sysTimeData, float64(evt.systemUsTime))
+	s.usrTimeData = appendPoint(s.usrTimeData, float64(evt.userUsTime))
+	s.callData = appendPoint(s.callData, float64(evt.callSize))
+	s.replyData = appendPoint(s.replyData, float64(evt.replySize))
+	s.durations = append(s.durations, evt.duration)
+	if len(s.durations) > 2*maxDurations {
+		s.durations = s.durations[len(s.durations)-maxDurations:]
+	}
+	failed := evt.responseType != net.Reply
+	s.updateRate(evt.timestamp, failed)
+	s.apdex.add(evt.duration, failed)
+	if s.slo != nil {
+		s.slo.add(evt.duration, failed)
 	}
-	c.sysTimeData = append(c.sysTimeData, float64(evt.systemUsTime))
-	c.usrTimeData = append(c.usrTimeData, float64(evt.userUsTime))
-	c.callData = append(c.callData, float64(evt.callSize))
-	c.replyData = append(c.replyData, float64(evt.replySize))
+}
+
+// updateEmission counts a signal emission.
+func (s *series) updateEmission(e bus.EventTrace) {
+	timestamp := time.Unix(e.Timestamp.Tv_sec, e.Timestamp.Tv_usec*1000)
+	size := len(value.Bytes(e.Arguments))
+	s.emissions++
+	s.bytes += size
+	s.callData = appendPoint(s.callData, float64(size))
+	s.updateRate(timestamp, false)
+}
+
+// updateRate counts a call in the bucket of its second.
+func (s *series) updateRate(timestamp time.Time, failed bool) {
+	second := timestamp.Unix()
+	if len(s.callRate) == 0 {
+		s.origin = second
+		s.latest = second
+	}
+	if second > s.latest {
+		s.latest = second
+	}
+	index := int(second - s.origin)
+	if index < 0 {
+		// older than the history
+		return
+	}
+	s.extendRate(index)
+	// the oldest buckets may have been dropped
+	index = int(second - s.origin)
+	if failed {
+		s.errorRate[index]++
+	} else {
+		s.callRate[index]++
+	}
+}
+
+// extendRate adds empty buckets up to index and drops the oldest
+// ones beyond the history.
+func (s *series) extendRate(index int) {
+	for len(s.callRate) <= index {
+		s.callRate = append(s.callRate, 0)
+		s.errorRate = append(s.errorRate, 0)
+	}
+	if len(s.callRate) > 2*maxRateSeconds {
+		drop := len(s.callRate) - maxRateSeconds
+		s.callRate = s.callRate[drop:]
+		s.errorRate = s.errorRate[drop:]
+		s.origin += int64(drop)
+	}
+}
+
+// fillRate adds the seconds without events up to now: the rate of an
+// idle member falls to zero.
+func (s *series) fillRate(now time.Time) {
+	if len(s.callRate) == 0 {
+		return
+	}
+	idle := int64(now.Sub(s.received) / time.Second)
+	s.extendRate(int(s.latest + idle - s.origin))
 }
 
 func (c *collector) refreshData(e1 bus.EventTrace) {
-	if e1.SlotId != c.slot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	method := c.methodName(e1.SlotId)
+
+	if e1.Kind == traceSignal {
+		c.debug.addTrace(method, e1, time.Time{}, 0)
+		s := c.getSeries(e1.SlotId)
+		s.updateEmission(e1)
+		s.received = c.now()
 		return
 	}
-	id := e1.Id
+	if e1.Kind == int32(net.Call) {
+		c.debug.addTrace(method, e1, time.Time{}, 0)
+	}
 
-	e0, ok := c.pending[id]
+	call, response, ok := matchEvent(c.pending, e1)
+	c.addPending(e1)
 	if !ok {
-		c.pending[id] = e1
 		return
 	}
-	delete(c.pending, id)
+	evt := newCallEvent(call, response)
+	s := c.getSeries(call.SlotId)
+	s.updateData(evt)
+	s.received = c.now()
+	c.debug.addTrace(method, response, evt.timestamp, evt.duration)
+	c.payloads.add(newPayload(c.metaMethod(call.SlotId), call, response, evt))
+}
+
+// matchEvent pairs the call and the response of a message. It returns
+// false until both have been received.
+func matchEvent(pending map[uint32]bus.EventTrace, e1 bus.EventTrace) (call, response bus.EventTrace, ok bool) {
+	e0, ok := pending[e1.Id]
+	if !ok {
+		pending[e1.Id] = e1
+		return call, response, false
+	}
+	delete(pending, e1.Id)
 
 	if e0.Kind == int32(net.Call) {
-		c.updateData(newCallEvent(e0, e1))
+		return e0, e1, true
 	} else if e1.Kind == int32(net.Call) {
-		c.updateData(newCallEvent(e1, e0))
-	} else {
-		// invalid
+		return e1, e0, true
+	}
+	// invalid
+	return call, response, false
+}
+
+// lastValues returns the max last values of data.
+func lastValues(max int, data []float64) []float64 {
+	if max >= 0 && len(data) > max {
+		return data[len(data)-max:]
 	}
+	return data
 }
 
 func noMoreThan(max int, data *[]float64) []float64 {
@@ -192,28 +495,156 @@ func noMoreThan(max int, data *[]float64) []float64 {
 }
 
 func (c *collector) updateUI(w *widgets) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending := pendingDetail(c.updatePending(w), c.evicted)
+	now := c.now()
+	for _, s := range c.series {
+		s.fillRate(now)
+	}
+	current, ok := c.series[c.slot]
+	if !ok {
+		// no event of the selected member yet: remove the data of
+		// the previous one.
+		c.clearStackedUI(w)
+		clearSeriesUI(w)
+		w.latencyHisto.Values(histogram(nil), 1)
+		showInfo(w, c.service, c.method, pending)
+		return
+	}
+	if c.stacked {
+		c.updateStackedUI(w)
+	} else {
+		c.clearStackedUI(w)
+		current.updateUI(w)
+	}
+
+	durations := current.durations
+	if len(durations) > maxDurations {
+		durations = durations[len(durations)-maxDurations:]
+	}
+	counts := histogram(durations)
+	max := 1
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+	w.latencyHisto.Values(counts, max)
+	details := []detail{
+		{
+			text: fmt.Sprintf("%d members traced (m/M: cycle, S: stack)",
+				len(c.series)),
+			color: cell.ColorDefault,
+		},
+		pending,
+	}
+	if current.kind != memberMethod {
+		details = append(details, current.emissionDetail())
+	} else {
+		details = append(details, percentiles(durations),
+			current.apdex.detail())
+	}
+	if current.slo != nil && current.kind == memberMethod {
+		details = append(details, current.slo.detail())
+	}
+	showInfo(w, c.service, c.method, details...)
+}
+
+// emissionDetail describes the emissions of a signal or a property.
+func (s *series) emissionDetail() detail {
+	size := 0
+	if s.emissions != 0 {
+		size = s.bytes / s.emissions
+	}
+	return detail{
+		text: fmt.Sprintf("%s: %d emissions, average payload: %d bytes",
+			s.kind, s.emissions, size),
+		color: cell.ColorMagenta,
+	}
+}
+
+func (s *series) updateUI(w *widgets) {
 	w.latencyPlot.Series("response time",
-		noMoreThan(w.latencyPlot.ValueCapacity(), &c.latencyData),
+		noMoreThan(w.latencyPlot.ValueCapacity(), &s.latencyData),
 		linechart.SeriesCellOpts(cell.FgColor(cell.ColorYellow)),
 	)
 	w.latencyPlot.Series("error response time",
-		noMoreThan(w.latencyPlot.ValueCapacity(), &c.latencyErrorData),
+		noMoreThan(w.latencyPlot.ValueCapacity(), &s.latencyErrorData),
+		linechart.SeriesCellOpts(cell.FgColor(cell.ColorRed)),
+	)
+	w.ratePlot.Series("calls",
+		lastValues(w.ratePlot.ValueCapacity(), s.callRate),
+		linechart.SeriesCellOpts(cell.FgColor(cell.ColorGreen)),
+	)
+	w.ratePlot.Series("errors",
+		lastValues(w.ratePlot.ValueCapacity(), s.errorRate),
 		linechart.SeriesCellOpts(cell.FgColor(cell.ColorRed)),
 	)
 	w.timePlot.Series("user time",
-		noMoreThan(w.timePlot.ValueCapacity(), &c.usrTimeData),
+		noMoreThan(w.timePlot.ValueCapacity(), &s.usrTimeData),
 		linechart.SeriesCellOpts(cell.FgColor(cell.ColorGreen)),
 	)
 	w.timePlot.Series("system time",
-		noMoreThan(w.timePlot.ValueCapacity(), &c.sysTimeData),
+		noMoreThan(w.timePlot.ValueCapacity(), &s.sysTimeData),
 		linechart.SeriesCellOpts(cell.FgColor(cell.ColorYellow)),
 	)
 	w.sizePlot.Series("call size",
-		noMoreThan(w.sizePlot.ValueCapacity(), &c.callData),
+		noMoreThan(w.sizePlot.ValueCapacity(), &s.callData),
 		linechart.SeriesCellOpts(cell.FgColor(cell.ColorGreen)),
 	)
 	w.sizePlot.Series("reply size",
-		noMoreThan(w.sizePlot.ValueCapacity(), &c.replyData),
+		noMoreThan(w.sizePlot.ValueCapacity(), &s.replyData),
 		linechart.SeriesCellOpts(cell.FgColor(cell.ColorYellow)),
 	)
 }
+
+// updateStackedUI draws one series per method: the reply latency,
+// the calls per second, the user time and the call size. Must be
+// called with the mutex held.
+func (c *collector) updateStackedUI(w *widgets) {
+	clearSeriesUI(w)
+	for i, s := range c.sortedSeries() {
+		color := stackColors[i%len(stackColors)]
+		opts := linechart.SeriesCellOpts(cell.FgColor(color))
+		w.latencyPlot.Series(s.method,
+			noMoreThan(w.latencyPlot.ValueCapacity(), &s.latencyData),
+			opts)
+		w.ratePlot.Series(s.method,
+			lastValues(w.ratePlot.ValueCapacity(), s.callRate), opts)
+		w.timePlot.Series(s.method,
+			noMoreThan(w.timePlot.ValueCapacity(), &s.usrTimeData), opts)
+		w.sizePlot.Series(s.method,
+			noMoreThan(w.sizePlot.ValueCapacity(), &s.callData), opts)
+	}
+}
+
+// clearSeriesUI removes the series drawn by series.updateUI.
+func clearSeriesUI(w *widgets) {
+	empty := []float64{}
+	for _, label := range []string{"response time", "error response time"} {
+		w.latencyPlot.Series(label, empty)
+	}
+	for _, label := range []string{"calls", "errors"} {
+		w.ratePlot.Series(label, empty)
+	}
+	for _, label := range []string{"user time", "system time"} {
+		w.timePlot.Series(label, empty)
+	}
+	for _, label := range []string{"call size", "reply size"} {
+		w.sizePlot.Series(label, empty)
+	}
+}
+
+// clearStackedUI removes the series drawn by updateStackedUI. Must
+// be called with the mutex held.
+func (c *collector) clearStackedUI(w *widgets) {
+	empty := []float64{}
+	for _, s := range c.series {
+		w.latencyPlot.Series(s.method, empty)
+		w.ratePlot.Series(s.method, empty)
+		w.timePlot.Series(s.method, empty)
+		w.sizePlot.Series(s.method, empty)
+	}
+}
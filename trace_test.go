@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lugu/qiloop/bus"
+	"github.com/lugu/qiloop/bus/net"
+	"github.com/lugu/qiloop/type/value"
+)
+
+func TestMatchEvent(t *testing.T) {
+	event := func(id uint32, kind uint8, sec int64) bus.EventTrace {
+		return bus.EventTrace{
+			Id:        id,
+			Kind:      int32(kind),
+			Timestamp: bus.Timeval{Tv_sec: sec},
+		}
+	}
+	tests := []struct {
+		name     string
+		events   []bus.EventTrace
+		ok       bool
+		call     int64
+		response int64
+		pending  int
+	}{
+		{"call", []bus.EventTrace{event(1, net.Call, 1)}, false, 0, 0, 1},
+		{"call and reply", []bus.EventTrace{
+			event(1, net.Call, 1), event(1, net.Reply, 2)}, true, 1, 2, 0},
+		{"reply first", []bus.EventTrace{
+			event(1, net.Reply, 2), event(1, net.Call, 1)}, true, 1, 2, 0},
+		{"error", []bus.EventTrace{
+			event(1, net.Call, 1), event(1, net.Error, 3)}, true, 1, 3, 0},
+		{"other message", []bus.EventTrace{
+			event(1, net.Call, 1), event(2, net.Reply, 2)}, false, 0, 0, 2},
+		{"no call", []bus.EventTrace{
+			event(1, net.Reply, 1), event(1, net.Error, 2)}, false, 0, 0, 0},
+	}
+	for _, test := range tests {
+		pending := map[uint32]bus.EventTrace{}
+		var call, response bus.EventTrace
+		var ok bool
+		for _, e := range test.events {
+			call, response, ok = matchEvent(pending, e)
+		}
+		if ok != test.ok {
+			t.Errorf("%s: got ok %v", test.name, ok)
+			continue
+		}
+		if ok && (call.Timestamp.Tv_sec != test.call ||
+			response.Timestamp.Tv_sec != test.response) {
+			t.Errorf("%s: got call %d response %d", test.name,
+				call.Timestamp.Tv_sec, response.Timestamp.Tv_sec)
+		}
+		if len(pending) != test.pending {
+			t.Errorf("%s: got %d pending, want %d", test.name,
+				len(pending), test.pending)
+		}
+	}
+}
+
+func TestRateFill(t *testing.T) {
+	// the clock of the traced process is one hour late.
+	remote := time.Unix(1000, 0)
+	local := remote.Add(time.Hour)
+	s := newSeries(1, "m", memberMethod)
+	s.fillRate(local)
+	if len(s.callRate) != 0 {
+		t.Fatalf("rate filled without event: %v", s.callRate)
+	}
+	s.updateRate(remote, false)
+	s.updateRate(remote.Add(time.Second), true)
+	s.received = local.Add(time.Second)
+
+	s.fillRate(local.Add(1500 * time.Millisecond))
+	if want := []float64{1, 0}; !reflect.DeepEqual(s.callRate, want) {
+		t.Errorf("calls: got %v, want %v", s.callRate, want)
+	}
+	s.fillRate(local.Add(4 * time.Second))
+	if want := []float64{1, 0, 0, 0, 0}; !reflect.DeepEqual(s.callRate, want) {
+		t.Errorf("idle calls: got %v, want %v", s.callRate, want)
+	}
+	if want := []float64{0, 1, 0, 0, 0}; !reflect.DeepEqual(s.errorRate, want) {
+		t.Errorf("idle errors: got %v, want %v", s.errorRate, want)
+	}
+}
+
+func TestSeriesBounded(t *testing.T) {
+	s := newSeries(1, "m", memberMethod)
+	for i := 0; i < 5*maxPoints; i++ {
+		kind := uint8(net.Reply)
+		if i%2 == 1 {
+			kind = net.Error
+		}
+		s.updateData(callEvent{
+			timestamp:    time.Unix(int64(i), 0),
+			duration:     time.Millisecond,
+			responseType: kind,
+		})
+		s.updateEmission(bus.EventTrace{
+			Timestamp: bus.Timeval{Tv_sec: int64(i)},
+			Arguments: value.Int(1),
+		})
+	}
+	data := map[string][]float64{
+		"latency":       s.latencyData,
+		"latency error": s.latencyErrorData,
+		"call size":     s.callData,
+		"reply size":    s.replyData,
+		"user time":     s.usrTimeData,
+		"system time":   s.sysTimeData,
+	}
+	for name, values := range data {
+		if len(values) > 2*maxPoints {
+			t.Errorf("%s: %d values kept", name, len(values))
+		}
+	}
+}